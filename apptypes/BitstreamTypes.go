@@ -0,0 +1,128 @@
+package healertypes
+
+// SPS holds the fields of a sequence parameter set (H.264 7.3.2.1.1) that
+// matter for playback and for parsing the slices that reference it.
+type SPS struct {
+	ProfileIDC      uint8
+	ConstraintFlags uint8 // constraint_set0_flag is the most significant bit
+	LevelIDC        uint8
+	ID              uint32
+
+	ChromaFormatIDC      uint32
+	SeparateColourPlane  bool
+	BitDepthLuma         uint32
+	BitDepthChroma       uint32
+	ScalingMatrixPresent bool
+
+	Log2MaxFrameNum         uint32
+	PicOrderCntType         uint32
+	Log2MaxPicOrderCntLsb   uint32
+	DeltaPicOrderAlwaysZero bool
+
+	MaxNumRefFrames       uint32
+	GapsInFrameNumAllowed bool
+	FrameMbsOnly          bool
+	MbAdaptiveFrameField  bool
+	Direct8x8Inference    bool
+
+	// Width and Height are in luma samples, after frame cropping.
+	Width        int
+	Height       int
+	CropLeft     uint32
+	CropRight    uint32
+	CropTop      uint32
+	CropBottom   uint32
+	FrameCropped bool
+
+	VUI *VUI
+}
+
+// VUI holds the video usability information of an SPS (H.264 E.1.1).
+type VUI struct {
+	AspectRatioInfoPresent bool
+	AspectRatioIDC         uint8
+	SARWidth               uint16
+	SARHeight              uint16
+
+	VideoFullRange bool
+
+	TimingInfoPresent bool
+	NumUnitsInTick    uint32
+	TimeScale         uint32
+	FixedFrameRate    bool
+
+	NalHRDPresent    bool
+	VclHRDPresent    bool
+	PicStructPresent bool
+
+	BitstreamRestriction bool
+	MaxNumReorderFrames  uint32
+	MaxDecFrameBuffering uint32
+}
+
+// FrameRate derives the frame rate from the timing info, or 0 when absent.
+func (v *VUI) FrameRate() float64 {
+	if v == nil || !v.TimingInfoPresent || v.NumUnitsInTick == 0 {
+		return 0
+	}
+	return float64(v.TimeScale) / float64(2*v.NumUnitsInTick)
+}
+
+// PPS holds the fields of a picture parameter set (H.264 7.3.2.2).
+type PPS struct {
+	ID                                uint32
+	SPSID                             uint32
+	EntropyCodingModeFlag             bool // CABAC when true, CAVLC otherwise
+	BottomFieldPicOrderInFramePresent bool
+	NumSliceGroups                    uint32
+	NumRefIdxL0DefaultActive          uint32
+	NumRefIdxL1DefaultActive          uint32
+	WeightedPred                      bool
+	WeightedBipredIDC                 uint32
+	PicInitQP                         int32
+	DeblockingFilterControlPresent    bool
+	ConstrainedIntraPred              bool
+	RedundantPicCntPresent            bool
+}
+
+// Slice types as coded in slice_type modulo 5 (H.264 table 7-6).
+const (
+	SliceP  = 0
+	SliceB  = 1
+	SliceI  = 2
+	SliceSP = 3
+	SliceSI = 4
+)
+
+// SliceHeader holds the leading fields of a coded slice header (H.264 7.3.3),
+// up to the picture order count fields.
+type SliceHeader struct {
+	NalRefIdc uint8
+	IDR       bool
+
+	FirstMbInSlice uint32
+	SliceType      uint32
+	PPSID          uint32
+
+	// The fields below need the referenced SPS and PPS; Complete reports
+	// whether they were parsed.
+	Complete               bool
+	ColourPlaneID          uint32
+	FrameNum               uint32
+	FieldPic               bool
+	BottomField            bool
+	IDRPicID               uint32
+	PicOrderCntLsb         uint32
+	DeltaPicOrderCntBottom int32
+	DeltaPicOrderCnt       [2]int32
+}
+
+// Type returns slice_type modulo 5, one of SliceP, SliceB, SliceI, SliceSP, SliceSI.
+func (s *SliceHeader) Type() uint32 {
+	return s.SliceType % 5
+}
+
+// IsB reports whether the slice is bi-predicted.
+func (s *SliceHeader) IsB() bool {
+	return s.Type() == SliceB
+}
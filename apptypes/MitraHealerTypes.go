@@ -10,10 +10,16 @@ type NaluInfo struct {
 	Pkt             *rtp.Packet
 	Sps             []byte
 	Pps             []byte
-	LastSequence    *uint16
 	IsIDR           bool
 	StartBit        bool
 	OriginalNalType byte
 	FuHeader        byte
 	EndBit          bool
+	NRI             byte
+	// ForbiddenBit is the F bit of the NAL unit header, or of the FU indicator:
+	// set by a middlebox on data known to contain bit errors (RFC 6184 5.3).
+	ForbiddenBit bool
+	// Slice is set for single NALU slices and FU-A start fragments of a slice,
+	// when the header could be parsed.
+	Slice *SliceHeader
 }
@@ -3,9 +3,13 @@ module mitra-sample-rtp-healer
 go 1.23.2
 
 require (
-	github.com/LacavaDev/mitra-rtp-healer v0.0.0-20250711011722-87d7329732b6 // indirect
-	github.com/bluenviron/gortsplib/v4 v4.15.0 // indirect
-	github.com/bluenviron/mediacommon/v2 v2.3.0 // indirect
+	github.com/LacavaDev/mitra-rtp-healer v0.0.0-20250711011722-87d7329732b6
+	github.com/bluenviron/gortsplib/v4 v4.15.0
+	github.com/bluenviron/mediacommon/v2 v2.3.0
+	github.com/pion/rtp v1.8.20
+)
+
+require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/pion/datachannel v1.5.8 // indirect
@@ -16,7 +20,6 @@ require (
 	github.com/pion/mdns v0.0.12 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
 	github.com/pion/rtcp v1.2.15 // indirect
-	github.com/pion/rtp v1.8.20 // indirect
 	github.com/pion/sctp v1.8.19 // indirect
 	github.com/pion/sdp/v3 v3.0.14 // indirect
 	github.com/pion/srtp/v2 v2.0.20 // indirect
@@ -34,3 +37,5 @@ require (
 	golang.org/x/sys v0.33.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace github.com/LacavaDev/mitra-rtp-healer => ../..
@@ -4,7 +4,9 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net"
+	"os"
 
+	"github.com/LacavaDev/mitra-rtp-healer/healer"
 	naluHelper "github.com/LacavaDev/mitra-rtp-healer/helper"
 	"github.com/bluenviron/gortsplib/v4"
 	"github.com/bluenviron/gortsplib/v4/pkg/base"
@@ -64,77 +66,53 @@ func main() {
 
 	fmt.Printf("sprop-parameter-sets=%s,%s \n", base64.StdEncoding.EncodeToString(forma.SPS), base64.StdEncoding.EncodeToString(forma.PPS))
 
-	var lastSequence uint16
-
 	udpAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", "0.0.0.0", 5004))
 
 	conn, _ := net.DialUDP("udp", nil, udpAddr)
 
 	defer conn.Close()
 
-	var collecting = false
-	var naluQeue []*rtp.Packet = []*rtp.Packet{}
-	naluChan := make(chan *rtp.Packet)
-
-	var pps, sps []byte
-	pps = forma.PPS
-	sps = forma.SPS
+	//ONE HEALER PER STREAM, IT OWNS THE FU-A QUEUE, THE SPS/PPS CACHE AND THE OUTPUT SEQUENCE
+	h264Healer := healer.NewH264Healer(
+		healer.WithMTU(maxNaluSize),
+		healer.WithParameterSets(forma.SPS, forma.PPS),
+	)
+	sdpWritten := false
+
+	//THE SINK RUNS IN ITS OWN GOROUTINE BEHIND A BOUNDED QUEUE, SO A SLOW WRITE NEVER STALLS THE RTSP SESSION
+	//WHEN IT FALLS BEHIND, NON-REFERENCE FRAMES ARE DROPPED FIRST, NEVER IDRS OR SPS/PPS
+	h264Healer.Subscribe(healer.SinkFunc(func(a *rtp.Packet) error {
+		//You can put your WebRTC logics here, example with pion webrtc: track.WriteRTP(a)
+		b, _ := a.Marshal()
+		conn.Write(b)
+		return nil
+	}), healer.WithQueuePolicy(healer.DropNonReference))
 
 	c.OnPacketRTPAny(func(medi *description.Media, f format.Format, pkt *rtp.Packet) {
 
-		if medi.Type != description.MediaTypeVideo && medi.Type != description.MediaTypeAudio {
-			return
-		}
-
-		payload := pkt.Payload
-		if len(payload) < 1 {
-			return
-		}
-
-		nalType := payload[0] & 0x1F
-
-		//NOT LISTED IN RFC 6184, JUST DISCARDS
-		if nalType > 29 {
+		if medi.Type != description.MediaTypeVideo {
 			return
 		}
 
-		/*sprop-parameter-set setup logics*/
-		if nalType == 7 {
-			sps = pkt.Payload
-			return
-		}
-		if nalType == 8 {
-			pps = pkt.Payload
-			return
+		//SETUP SDP FILE TO FFPLAY DEBUG, AS SOON AS SPS/PPS ARE KNOWN
+		if !sdpWritten {
+			sdp, err := h264Healer.SDP(naluHelper.SDPConfig{
+				SessionName: "Mitra RTP Healer example",
+				Address:     "127.0.0.1",
+				Port:        5004,
+			})
+			if err == nil {
+				sdpWritten = os.WriteFile("stream.sdp", []byte(sdp), 0644) == nil
+			}
 		}
 
-		//SETUP SDP FILE TO FFPLAY DEBUG
-		naluHelper.SaveSPSPPSIfNotExists(pps, sps, "sps_pps.bin")
-
-		bytesHeader, _ := pkt.Header.Marshal()
-		_, exceeds := naluHelper.NaluExceedsMTU(bytesHeader, pkt.Payload, maxNaluSize)
-		allNaluInfo := naluHelper.RetrieveNaluInfo(pkt, sps, pps, &lastSequence, nil /* <- this is an TrackLocalStaticRTP object for webrtc streaming purposes*/)
-
-		if nalType == 28 {
-			naluHelper.MakeFUAStreamApproach(exceeds, naluChan, &allNaluInfo, &naluQeue, &collecting, maxNaluSize)
-			return
-		} else if nalType > 0 {
-			naluHelper.MakeSingleNaluStreamApproach(exceeds, naluChan, &allNaluInfo, &naluQeue, &collecting, maxNaluSize)
-			return
+		//THE HEALED PACKETS ARE DELIVERED TO THE SUBSCRIPTION
+		if _, err := h264Healer.Push(pkt); err != nil {
+			//packets delivered alongside an error are still valid
+			fmt.Printf("[ERROR]: error at RTP healing %s \n", err)
 		}
 	})
 	fmt.Println("RTP STREAM INITIATED, PLEASE RUN ffplay -protocol_whitelist \"file,udp,rtp\" -loglevel debug -i stream.sdp")
-	go func() {
-		for a := range naluChan {
-			//Goroutine that is listening new RTP packets to streaming purposes
-			//You can put your WebRTC logics here, example with pion webrtc: track.WriteRTP(a)
-			a.SequenceNumber = lastSequence
-			lastSequence++
-			b, _ := a.Marshal()
-			conn.Write(b)
-
-		}
-	}()
 
 	_, err = c.Play(nil)
 	if err != nil {
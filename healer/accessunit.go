@@ -0,0 +1,207 @@
+package healer
+
+import (
+	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
+	"github.com/LacavaDev/mitra-rtp-healer/helper"
+)
+
+// AccessUnit groups every NAL unit of one picture (H.264 7.4.1.2.3), all
+// sharing the same RTP timestamp.
+type AccessUnit struct {
+	Timestamp  uint32
+	SSRC       uint32
+	NALUs      [][]byte
+	IsKeyframe bool
+	// Marker reports whether the source closed the access unit with the RTP
+	// marker bit, rather than the healer detecting the boundary itself.
+	Marker bool
+	// FirstSlice is the header of the first coded slice, when it could be parsed.
+	FirstSlice *healerTypes.SliceHeader
+	// Incomplete reports that at least one NAL unit was dropped or truncated
+	// because some of its FU-A fragments were lost, or was flagged as damaged
+	// with the F bit, whatever the IncompletePolicy.
+	Incomplete bool
+
+	// sources[i] lists the source packets NALUs[i] came from, when known.
+	sources []nalSource
+}
+
+// AccessUnitAssembler groups complete NAL units into access units. A boundary
+// is detected on a timestamp change, on a slice starting a new picture
+// (first_mb_in_slice and the other 7.4.1.2.4 comparisons), on a non-VCL NAL
+// unit following the slices of a picture, and after a packet with the marker
+// bit. It is not safe for concurrent use; the healer serialises access.
+type AccessUnitAssembler struct {
+	// TrustMarker closes an access unit as soon as a packet has the marker
+	// bit. Disable it for cameras that mark every slice: boundaries are then
+	// detected from the next NAL unit, at the cost of one access unit of delay.
+	TrustMarker bool
+
+	paramSets *ParameterSetStore
+
+	current   *AccessUnit
+	hasSlices bool
+	lastSlice *healerTypes.SliceHeader
+	// lost is a NAL unit dropped before its access unit started, see markLost.
+	lost    lostNALU
+	hasLost bool
+}
+
+// NewAccessUnitAssembler creates an assembler parsing slices with paramSets.
+func NewAccessUnitAssembler(paramSets *ParameterSetStore) *AccessUnitAssembler {
+	return &AccessUnitAssembler{TrustMarker: true, paramSets: paramSets}
+}
+
+// Push adds one complete NAL unit. marker is the marker bit of the RTP packet
+// that carried the end of the NAL unit. It returns the access units the NAL
+// unit completed, in order.
+func (a *AccessUnitAssembler) Push(nalu []byte, timestamp uint32, ssrc uint32, marker bool) []*AccessUnit {
+	return a.push(nalu, timestamp, ssrc, marker, false, nalSource{})
+}
+
+// push is Push recording the source packets of the NAL unit. incomplete flags
+// its access unit as Incomplete before the marker bit may complete it.
+func (a *AccessUnitAssembler) push(nalu []byte, timestamp uint32, ssrc uint32, marker bool, incomplete bool, src nalSource) []*AccessUnit {
+	if len(nalu) < 1 {
+		return nil
+	}
+
+	var (
+		completed []*AccessUnit
+		nalType   = nalu[0] & 0x1F
+		slice     *healerTypes.SliceHeader
+	)
+
+	if nalType == 1 || nalType == 5 {
+		slice, _ = a.paramSets.ParseSlice(nalu)
+	}
+
+	if a.current != nil && a.startsNewAccessUnit(nalType, slice, timestamp) {
+		completed = append(completed, a.Flush())
+	}
+
+	if a.current == nil {
+		a.current = &AccessUnit{Timestamp: timestamp, SSRC: ssrc}
+		if a.hasLost {
+			a.current.Incomplete = a.lost == lostNALU{timestamp: timestamp, ssrc: ssrc}
+			a.hasLost = false
+		}
+	}
+	a.current.NALUs = append(a.current.NALUs, append([]byte(nil), nalu...))
+	a.current.sources = append(a.current.sources, src)
+	if nalType == 5 {
+		a.current.IsKeyframe = true
+	}
+	if incomplete {
+		a.current.Incomplete = true
+	}
+	if nalType == 1 || nalType == 5 {
+		a.hasSlices = true
+		if a.current.FirstSlice == nil {
+			a.current.FirstSlice = slice
+		}
+		if slice != nil {
+			a.lastSlice = slice
+		}
+	}
+
+	if marker && a.TrustMarker {
+		a.current.Marker = true
+		completed = append(completed, a.Flush())
+	}
+	return completed
+}
+
+// hasSlices reports whether the access unit carries at least one coded slice.
+func (au *AccessUnit) hasSlices() bool {
+	for _, nalu := range au.NALUs {
+		if nalType := nalu[0] & 0x1F; nalType == 1 || nalType == 5 {
+			return true
+		}
+	}
+	return false
+}
+
+// IsReference reports whether other pictures may reference this one: one of
+// its slices has a non-zero nal_ref_idc. A non-reference access unit can be
+// dropped without breaking the decoding of the rest of the stream.
+func (au *AccessUnit) IsReference() bool {
+	for _, nalu := range au.NALUs {
+		if nalType := nalu[0] & 0x1F; (nalType == 1 || nalType == 5) && nalu[0]&0x60 != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasParameterSets reports whether the access unit carries an SPS or a PPS.
+func (au *AccessUnit) hasParameterSets() bool {
+	for _, nalu := range au.NALUs {
+		if nalType := nalu[0] & 0x1F; nalType == 7 || nalType == 8 {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkIncomplete flags the access unit being assembled as Incomplete.
+func (a *AccessUnitAssembler) MarkIncomplete() {
+	if a.current != nil {
+		a.current.Incomplete = true
+	}
+}
+
+// markLost flags the access unit of a NAL unit dropped by the reassembler as
+// Incomplete: the one being assembled when it has the same timestamp and
+// SSRC, otherwise the next one if it does.
+func (a *AccessUnitAssembler) markLost(lost lostNALU) {
+	if a.current != nil && a.current.Timestamp == lost.timestamp && a.current.SSRC == lost.ssrc {
+		a.current.Incomplete = true
+		return
+	}
+	a.lost = lost
+	a.hasLost = true
+}
+
+// Pending reports whether an access unit is being assembled.
+func (a *AccessUnitAssembler) Pending() bool {
+	return a.current != nil
+}
+
+// Discard drops the access unit being assembled.
+func (a *AccessUnitAssembler) Discard() {
+	a.Flush()
+}
+
+// Flush returns the access unit being assembled, or nil when there is none.
+func (a *AccessUnitAssembler) Flush() *AccessUnit {
+	au := a.current
+	a.current = nil
+	a.hasSlices = false
+	a.lastSlice = nil
+	return au
+}
+
+func (a *AccessUnitAssembler) startsNewAccessUnit(nalType byte, slice *healerTypes.SliceHeader, timestamp uint32) bool {
+	if timestamp != a.current.Timestamp {
+		return true
+	}
+	if !a.hasSlices {
+		return false
+	}
+
+	switch {
+	case nalType == 1 || nalType == 5:
+		if slice == nil {
+			return false
+		}
+		if a.lastSlice == nil {
+			return slice.FirstMbInSlice == 0
+		}
+		return helper.FirstSliceOfNewPicture(a.lastSlice, slice)
+	case nalType == 6 || nalType == 7 || nalType == 8 || nalType == 9 || (nalType >= 14 && nalType <= 18):
+		// SEI, parameter sets, AUD and reserved types only precede the slices of a picture
+		return true
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package healer
+
+import (
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// FeedbackStats counts the keyframe requests received from viewers.
+type FeedbackStats struct {
+	PLI uint64
+	FIR uint64
+	// Throttled counts the requests not forwarded upstream because one was
+	// sent less than the keyframe request interval ago.
+	Throttled uint64
+	// Replays counts the GOP cache replays served to a subscription.
+	Replays uint64
+}
+
+// HandleRTCP reacts to the PLI and FIR of the viewers: SPS/PPS are injected
+// ahead of the next picture and a KeyframeRequest with the ViewerRequest
+// reason is passed to the OnKeyframeRequest callbacks, at most once per
+// WithKeyframeRequestInterval. Other RTCP packets are ignored. It reports
+// whether pkts requested a keyframe.
+//
+// Feed it from the RTCP read loop of each sender (RTPSender.ReadRTCP), or use
+// Subscription.HandleRTCP to also serve the GOP cache to that viewer.
+func (h *H264Healer) HandleRTCP(pkts []rtcp.Packet) bool {
+	pli, fir := keyframeRequests(pkts, func(uint32) bool { return true })
+	return h.keyframeRequested(pli, fir)
+}
+
+// HandleRTCP handles the feedback of the viewer of this subscription like
+// H264Healer.HandleRTCP. When the healer has a GOP cache, a keyframe request
+// also replays it to this subscription, in place of its queued access units,
+// so the viewer recovers without waiting for the next IDR. The replay takes
+// timestamps after the last one the viewer received, and the live packets are
+// shifted to follow it. Replays are rate limited like the requests sent
+// upstream.
+func (s *Subscription) HandleRTCP(pkts []rtcp.Packet) {
+	pli, fir := keyframeRequests(pkts, func(uint32) bool { return true })
+	s.keyframeRequested(pli, fir)
+}
+
+func (s *Subscription) keyframeRequested(pli uint64, fir uint64) {
+	if s.healer.keyframeRequested(pli, fir) {
+		s.healer.replayTo(s)
+	}
+}
+
+func (h *H264Healer) keyframeRequested(pli uint64, fir uint64) bool {
+	if pli+fir == 0 {
+		return false
+	}
+
+	h.mu.Lock()
+	h.feedback.PLI += pli
+	h.feedback.FIR += fir
+	h.injector.force()
+	if !h.gate.forward(h.lastSSRC, time.Now()) {
+		h.feedback.Throttled++
+	}
+	ev := events{
+		keyframeRequests:  h.gate.takeRequests(),
+		keyframeCallbacks: h.keyframeCallbacks,
+	}
+	h.mu.Unlock()
+
+	ev.deliver()
+	return true
+}
+
+// replayTo replaces the queue of sub with a replay of the GOP cache.
+func (h *H264Healer) replayTo(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if h.gopCache == nil || now.Sub(sub.lastReplay) < h.gate.interval {
+		return
+	}
+	units := h.replay()
+	if len(units) == 0 {
+		return
+	}
+	sub.lastReplay = now
+	h.feedback.Replays++
+	sub.queue.reset(units)
+}
+
+// keyframeRequests counts the PLI and FIR of pkts whose media SSRC matches.
+func keyframeRequests(pkts []rtcp.Packet, match func(ssrc uint32) bool) (pli uint64, fir uint64) {
+	for _, pkt := range pkts {
+		switch p := pkt.(type) {
+		case *rtcp.PictureLossIndication:
+			if match(p.MediaSSRC) {
+				pli++
+			}
+		case *rtcp.FullIntraRequest:
+			for _, entry := range p.FIR {
+				if match(entry.SSRC) {
+					fir++
+					break
+				}
+			}
+		}
+	}
+	return pli, fir
+}
@@ -0,0 +1,143 @@
+package healer
+
+import "time"
+
+// GateTrigger selects the events after which the healer waits for a keyframe,
+// suppressing the access units a decoder could not use. Triggers are bit flags
+// and can be combined.
+type GateTrigger uint8
+
+const (
+	// GateOnStart waits for the first IDR of the stream.
+	GateOnStart GateTrigger = 1 << iota
+	// GateOnLoss waits for an IDR after a source sequence number gap.
+	GateOnLoss
+	// GateOnSSRCChange waits for an IDR when the source SSRC changes.
+	GateOnSSRCChange
+)
+
+// KeyframeReason tells why a KeyframeRequest was emitted.
+type KeyframeReason uint8
+
+const (
+	// StartRequest: the gate closed at the start of the stream (GateOnStart).
+	StartRequest KeyframeReason = iota + 1
+	// LossRequest: the gate closed on a sequence number gap (GateOnLoss).
+	LossRequest
+	// SSRCChangeRequest: the gate closed on a new source SSRC (GateOnSSRCChange).
+	SSRCChangeRequest
+	// ViewerRequest: a viewer sent PLI or FIR (HandleRTCP).
+	ViewerRequest
+)
+
+// reason returns the reason of the keyframe requests sent for a closed gate.
+func (t GateTrigger) reason() KeyframeReason {
+	switch t {
+	case GateOnStart:
+		return StartRequest
+	case GateOnLoss:
+		return LossRequest
+	default:
+		return SSRCChangeRequest
+	}
+}
+
+// DefaultKeyframeRequestInterval is the minimum time between two keyframe
+// requests sent upstream. While the gate stays closed a keyframe is requested
+// again at this pace, in case the previous request was lost.
+const DefaultKeyframeRequestInterval = time.Second
+
+// KeyframeRequest is emitted when the healer needs an IDR from the source.
+type KeyframeRequest struct {
+	// Reason is the event that closed the gate, or ViewerRequest.
+	Reason KeyframeReason
+	// SSRC is the source SSRC the keyframe is needed for.
+	SSRC uint32
+}
+
+// GatingStats counts the work of the keyframe gate.
+type GatingStats struct {
+	// Suppressed counts access units dropped while waiting for an IDR.
+	Suppressed uint64
+	// KeyframeRequests counts the KeyframeRequest events emitted.
+	KeyframeRequests uint64
+}
+
+// keyframeGate suppresses non-IDR access units from the moment an enabled
+// trigger fires until a complete IDR access unit goes through. It also rate
+// limits the keyframe requests, whatever their reason.
+type keyframeGate struct {
+	triggers GateTrigger
+	interval time.Duration
+	stats    GatingStats
+
+	closed      bool
+	reason      KeyframeReason
+	ssrc        uint32
+	lastRequest time.Time
+	requests    []KeyframeRequest
+}
+
+// close shuts the gate if trigger is enabled and queues a keyframe request,
+// unless one was sent less than the interval ago: admit asks again later.
+func (g *keyframeGate) close(trigger GateTrigger, ssrc uint32, now time.Time) {
+	if g.triggers&trigger == 0 || (g.closed && g.ssrc == ssrc) {
+		return
+	}
+	g.closed = true
+	g.reason = trigger.reason()
+	g.ssrc = ssrc
+	if g.due(now) {
+		g.request(now)
+	}
+}
+
+// admit reports whether au may be sent, and whether it reopened the gate.
+func (g *keyframeGate) admit(au *AccessUnit, now time.Time) (admitted bool, opened bool) {
+	if !g.closed {
+		return true, false
+	}
+	if au.IsKeyframe && !au.Incomplete {
+		g.closed = false
+		return true, true
+	}
+	if !au.hasSlices() {
+		// SEI and parameter sets alone: nothing a viewer would miss
+		return false, false
+	}
+	g.stats.Suppressed++
+	if g.due(now) {
+		g.request(now)
+	}
+	return false, false
+}
+
+// forward queues a keyframe request on behalf of a viewer, unless one was
+// sent less than the interval ago. It reports whether the request was queued.
+func (g *keyframeGate) forward(ssrc uint32, now time.Time) bool {
+	if !g.due(now) {
+		return false
+	}
+	g.lastRequest = now
+	g.stats.KeyframeRequests++
+	g.requests = append(g.requests, KeyframeRequest{Reason: ViewerRequest, SSRC: ssrc})
+	return true
+}
+
+// due reports whether the interval since the last keyframe request elapsed.
+func (g *keyframeGate) due(now time.Time) bool {
+	return g.lastRequest.IsZero() || now.Sub(g.lastRequest) >= g.interval
+}
+
+func (g *keyframeGate) request(now time.Time) {
+	g.lastRequest = now
+	g.stats.KeyframeRequests++
+	g.requests = append(g.requests, KeyframeRequest{Reason: g.reason, SSRC: g.ssrc})
+}
+
+// takeRequests returns the queued keyframe requests and clears the queue.
+func (g *keyframeGate) takeRequests() []KeyframeRequest {
+	requests := g.requests
+	g.requests = nil
+	return requests
+}
@@ -0,0 +1,80 @@
+package healer
+
+import "sync"
+
+// DefaultGOPCacheSize is the number of access units a GOP cache keeps when
+// WithGOPCache is given zero: 10 seconds of 30 fps video.
+const DefaultGOPCacheSize = 300
+
+// GOPCache keeps the access units of the current group of pictures, from the
+// last complete IDR on, with the SPS/PPS that IDR references. A late joiner
+// replays it to start decoding right away instead of waiting for the next IDR.
+//
+// A GOP longer than the cache is dropped rather than truncated, since its
+// later pictures cannot be decoded without the earlier ones; caching resumes
+// at the next IDR. It is safe for concurrent use.
+type GOPCache struct {
+	mu       sync.Mutex
+	maxUnits int
+	units    []*AccessUnit
+	sps      []byte
+	pps      []byte
+}
+
+// NewGOPCache creates a cache holding at most maxUnits access units.
+func NewGOPCache(maxUnits int) *GOPCache {
+	if maxUnits <= 0 {
+		maxUnits = DefaultGOPCacheSize
+	}
+	return &GOPCache{maxUnits: maxUnits}
+}
+
+// Add records an access unit sent to the viewers, with the parameter sets its
+// slices reference. Access units are kept by reference and must not be modified.
+func (c *GOPCache) Add(au *AccessUnit, sps []byte, pps []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if au.IsKeyframe && !au.Incomplete && len(sps) > 0 && len(pps) > 0 {
+		c.units = append(c.units[:0:0], au)
+		c.sps = append([]byte(nil), sps...)
+		c.pps = append([]byte(nil), pps...)
+		return
+	}
+	if len(c.units) == 0 {
+		return
+	}
+	if len(c.units) == c.maxUnits {
+		c.reset()
+		return
+	}
+	c.units = append(c.units, au)
+}
+
+// Snapshot returns the cached access units, oldest first, and their parameter
+// sets. units is empty until the first complete IDR.
+func (c *GOPCache) Snapshot() (units []*AccessUnit, sps []byte, pps []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*AccessUnit(nil), c.units...), c.sps, c.pps
+}
+
+// Len returns the number of cached access units.
+func (c *GOPCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.units)
+}
+
+// Reset empties the cache, typically after an SSRC change.
+func (c *GOPCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reset()
+}
+
+func (c *GOPCache) reset() {
+	c.units = nil
+	c.sps = nil
+	c.pps = nil
+}
@@ -0,0 +1,643 @@
+// Package healer wraps the stateless building blocks from the helper package
+// into a per-stream object that owns every piece of reassembly state.
+//
+// Callers used to hand-carry the FU-A queue, the collecting flag, the last
+// output sequence number and the SPS/PPS pair across RTSP callbacks. An
+// H264Healer keeps all of that internally: build one per incoming stream and
+// feed it every RTP packet through Push.
+package healer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
+	"github.com/LacavaDev/mitra-rtp-healer/helper"
+	"github.com/pion/rtp"
+)
+
+const (
+	// DefaultMTU is the maximum size of an output RTP packet, header
+	// included, used when WithMTU is not set.
+	DefaultMTU = 1200
+	// DefaultPayloadType is the dynamic payload type commonly negotiated for H.264.
+	DefaultPayloadType = 96
+)
+
+// H264Healer reassembles, re-fragments and re-sequences the H.264 RTP packets
+// of a single stream. It is safe for concurrent use.
+type H264Healer struct {
+	mu sync.Mutex
+
+	mtu         int
+	payloadType uint8
+	ssrc        uint32
+	rewriteSSRC bool
+
+	paramSets *ParameterSetStore
+
+	jitter      *JitterBuffer
+	reassembler *fuaReassembler
+
+	maxBufferedPackets int
+	// pendingPackets counts the source packets behind the NAL units of the
+	// access unit being assembled.
+	pendingPackets int
+	overflows      OverflowStats
+
+	sequencer *Sequencer
+	injector  *injector
+	tap       Tap
+
+	assembler      *AccessUnitAssembler
+	completedUnits []*AccessUnit
+	auCallbacks    []func(*AccessUnit)
+
+	gopCache    *GOPCache
+	subscribers []*Subscription
+	// emittedUnits are the access units sent since the last collect, for
+	// the subscriptions.
+	emittedUnits []outputUnit
+
+	gate              *keyframeGate
+	keyframeCallbacks []func(KeyframeRequest)
+	feedback          FeedbackStats
+
+	seqMap *SequenceMap
+	// lastSeq and lastSSRC describe the last source packet, to detect loss
+	// and SSRC changes.
+	lastSeq  uint16
+	lastSSRC uint32
+	hasLast  bool
+}
+
+// NewH264Healer creates a healer for one H.264 stream.
+func NewH264Healer(opts ...Option) *H264Healer {
+	paramSets := NewParameterSetStore()
+	h := &H264Healer{
+		mtu:         DefaultMTU,
+		payloadType: DefaultPayloadType,
+		paramSets:   paramSets,
+		sequencer:   NewSequencer(0),
+		injector:    newInjector(DefaultInjectionPolicy()),
+		reassembler: newFUAReassembler(),
+		gate:        &keyframeGate{interval: DefaultKeyframeRequestInterval},
+
+		maxBufferedPackets: helper.DefaultMaxBufferedPackets,
+		assembler:          NewAccessUnitAssembler(paramSets),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Push feeds one packet received from the source and returns the healed
+// packets that are ready to be sent, already carrying their output sequence
+// numbers. Output is produced per access unit: packets come out once the
+// access unit they belong to is complete (marker bit, or the first NAL unit of
+// the next one), and only the last packet of each access unit has the marker
+// bit set. A nil slice means the packet was buffered.
+//
+// Errors wrap the helper sentinels (helper.ErrMissingStartFragment,
+// helper.ErrMissingParameterSets, ...). Packets returned together with an
+// error are still valid and should be sent.
+//
+// The healer keeps pkt and its Payload after Push returns: FU-A fragments,
+// buffered NAL units and the returned packets refer to it. Callers must not
+// reuse the packet or its buffer; copy it first when the reader recycles it,
+// as HealingTrack.WriteRTP does.
+func (h *H264Healer) Push(pkt *rtp.Packet) ([]*rtp.Packet, error) {
+	if pkt == nil || len(pkt.Payload) < 1 {
+		return nil, &helper.PayloadError{Length: 0, Needed: 1}
+	}
+
+	h.mu.Lock()
+	var pushErr error
+	if h.jitter == nil {
+		pushErr = h.pushAll([]*rtp.Packet{pkt})
+	} else {
+		pushErr = h.pushAll(h.jitter.Push(pkt, time.Now()))
+	}
+	out, events, emitErr := h.collect()
+	h.mu.Unlock()
+
+	events.deliver()
+	return out, errors.Join(pushErr, emitErr)
+}
+
+// Poll releases the packets the jitter buffer stopped waiting on, and heals
+// them. Call it every few milliseconds when WithJitterBuffer is set, so
+// packets leave on time even when the source pauses. It is a no-op otherwise.
+func (h *H264Healer) Poll() ([]*rtp.Packet, error) {
+	h.mu.Lock()
+	if h.jitter == nil {
+		h.mu.Unlock()
+		return nil, nil
+	}
+	pushErr := h.pushAll(h.jitter.Poll(time.Now()))
+	out, events, emitErr := h.collect()
+	h.mu.Unlock()
+
+	events.deliver()
+	return out, errors.Join(pushErr, emitErr)
+}
+
+// pushAll feeds packets in order, enforcing the buffer limit after each one.
+func (h *H264Healer) pushAll(pkts []*rtp.Packet) error {
+	var errs []error
+	for _, pkt := range pkts {
+		if err := h.push(pkt); err != nil {
+			errs = append(errs, err)
+		}
+		if err := h.enforceBufferLimit(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Flush emits the access unit still being assembled, typically when the
+// source stops. Sources that never set the marker bit keep their last access
+// unit buffered until the next one starts or Flush is called. Packets held by
+// the jitter buffer are released first, and a FU-A still waiting for its end
+// fragment is handled per the IncompletePolicy.
+func (h *H264Healer) Flush() ([]*rtp.Packet, error) {
+	h.mu.Lock()
+	var jitterErr error
+	if h.jitter != nil {
+		jitterErr = h.pushAll(h.jitter.Flush())
+	}
+	fuaErr := errors.Join(jitterErr, h.assembleFUA(h.reassembler.interrupt()))
+	if au := h.assembler.Flush(); au != nil {
+		h.completedUnits = append(h.completedUnits, au)
+	}
+	h.pendingPackets = 0
+	out, events, err := h.collect()
+	h.mu.Unlock()
+
+	events.deliver()
+	return out, errors.Join(fuaErr, err)
+}
+
+// OnAccessUnit registers cb to receive every access unit the healer
+// assembles, in stream order. Callbacks run on the goroutine calling Push,
+// after the healer released its lock; the NAL units must not be modified.
+func (h *H264Healer) OnAccessUnit(cb func(*AccessUnit)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.auCallbacks = append(h.auCallbacks, cb)
+}
+
+// OnKeyframeRequest registers cb to be told when the keyframe gate closes and
+// the caller should ask the source for an IDR, e.g. with an RTSP or RTCP
+// request. While the gate stays closed the request is repeated every second.
+// Callbacks run like the OnAccessUnit ones.
+func (h *H264Healer) OnKeyframeRequest(cb func(KeyframeRequest)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keyframeCallbacks = append(h.keyframeCallbacks, cb)
+}
+
+// push splits pkt into complete NAL units and feeds them to the assembler.
+func (h *H264Healer) push(pkt *rtp.Packet) error {
+	nalType := pkt.Payload[0] & 0x1F
+	h.track(pkt)
+
+	expireErr := h.assembleFUA(h.reassembler.expire(time.Now()))
+	if nalType == 28 {
+		return errors.Join(expireErr, h.pushFUA(pkt))
+	}
+	if nalType > 0 && nalType < 25 {
+		// a NAL unit of another kind ends any FU-A still being reassembled
+		expireErr = errors.Join(expireErr, h.assembleFUA(h.reassembler.interrupt()))
+	}
+	return errors.Join(expireErr, h.pushNALUs(pkt, nalType))
+}
+
+// track closes the keyframe gate on the first packet, on a sequence number gap
+// and on an SSRC change.
+func (h *H264Healer) track(pkt *rtp.Packet) {
+	now := time.Now()
+	switch {
+	case !h.hasLast:
+		h.gate.close(GateOnStart, pkt.SSRC, now)
+	case pkt.SSRC != h.lastSSRC:
+		h.gate.close(GateOnSSRCChange, pkt.SSRC, now)
+		if h.gopCache != nil {
+			// the cached pictures belong to the previous source
+			h.gopCache.Reset()
+		}
+	case pkt.SequenceNumber != h.lastSeq+1:
+		h.gate.close(GateOnLoss, pkt.SSRC, now)
+	}
+	h.lastSeq = pkt.SequenceNumber
+	h.lastSSRC = pkt.SSRC
+	h.hasLast = true
+}
+
+// pushNALUs feeds the NAL units of a single NAL unit or STAP-A packet.
+func (h *H264Healer) pushNALUs(pkt *rtp.Packet, nalType byte) error {
+	switch {
+	case nalType == 24:
+		nalus, err := helper.SplitSTAPAPacket(pkt.Payload)
+		if err != nil {
+			return err
+		}
+		var (
+			errs  []error
+			valid [][]byte
+		)
+		for _, nalu := range nalus {
+			if innerType := nalu[0] & 0x1F; innerType == 0 || innerType > 23 {
+				// aggregation and fragmentation units cannot be nested (RFC 6184 5.7.1)
+				errs = append(errs, fmt.Errorf("%w: NAL type %d inside STAP-A", helper.ErrMalformedPayload, innerType))
+				continue
+			}
+			valid = append(valid, nalu)
+		}
+		for i, nalu := range valid {
+			if _, err := h.paramSets.Learn(nalu); err != nil {
+				errs = append(errs, err)
+			}
+			// the packet is accounted for with its first NAL unit
+			packets := 0
+			if i == 0 {
+				packets = 1
+			}
+			h.assemble(nalu, &pkt.Header, pkt.Marker && i == len(valid)-1, false, packets, singleSource(pkt.SequenceNumber, len(nalu)))
+		}
+		return errors.Join(errs...)
+	case nalType > 0 && nalType < 24:
+		_, err := h.paramSets.Learn(pkt.Payload)
+		h.assemble(pkt.Payload, &pkt.Header, pkt.Marker, false, 1, singleSource(pkt.SequenceNumber, len(pkt.Payload)))
+		return err
+	}
+
+	// STAP-B, MTAP and FU-B are not allowed in packetization-mode 1
+	return nil
+}
+
+// events holds what the callbacks must be told once the lock is released.
+type events struct {
+	emitted           []outputUnit
+	subscribers       []*Subscription
+	units             []*AccessUnit
+	auCallbacks       []func(*AccessUnit)
+	keyframeRequests  []KeyframeRequest
+	keyframeCallbacks []func(KeyframeRequest)
+}
+
+func (e events) deliver() {
+	if len(e.emitted) > 0 {
+		for _, sub := range e.subscribers {
+			sub.enqueue(e.emitted)
+		}
+	}
+	for _, req := range e.keyframeRequests {
+		for _, cb := range e.keyframeCallbacks {
+			cb(req)
+		}
+	}
+	for _, au := range e.units {
+		for _, cb := range e.auCallbacks {
+			cb(au)
+		}
+	}
+}
+
+// collect emits the completed access units and gathers the events for the
+// callbacks, which run once the lock is released.
+func (h *H264Healer) collect() ([]*rtp.Packet, events, error) {
+	var (
+		out  []*rtp.Packet
+		errs []error
+	)
+	for _, au := range h.completedUnits {
+		pkts, err := h.emitAccessUnit(au)
+		out = append(out, pkts...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	ev := events{
+		emitted:           h.emittedUnits,
+		subscribers:       h.subscribers,
+		units:             h.completedUnits,
+		auCallbacks:       h.auCallbacks,
+		keyframeRequests:  h.gate.takeRequests(),
+		keyframeCallbacks: h.keyframeCallbacks,
+	}
+	h.completedUnits = nil
+	h.emittedUnits = nil
+	return out, ev, errors.Join(errs...)
+}
+
+// SequenceMap returns the sequence map of the output returned by Push, nil
+// unless WithSequenceMap was given.
+func (h *H264Healer) SequenceMap() *SequenceMap {
+	return h.seqMap
+}
+
+// ParameterSets returns a copy of the most recently learned SPS and PPS.
+func (h *H264Healer) ParameterSets() (sps []byte, pps []byte) {
+	sps, pps = h.paramSets.Latest()
+	return append([]byte(nil), sps...), append([]byte(nil), pps...)
+}
+
+// ParameterSetStore returns the store holding every SPS/PPS seen on the stream.
+func (h *H264Healer) ParameterSetStore() *ParameterSetStore {
+	return h.paramSets
+}
+
+// StreamInfo decodes the latest SPS: profile, level, resolution, VUI...
+func (h *H264Healer) StreamInfo() (*healerTypes.SPS, error) {
+	sps, _ := h.paramSets.Latest()
+	if len(sps) == 0 {
+		return nil, helper.ErrMissingParameterSets
+	}
+	return helper.ParseSPS(sps)
+}
+
+// SetParameterSets records an SPS and a PPS, typically the sprop-parameter-sets
+// announced by the RTSP DESCRIBE response.
+func (h *H264Healer) SetParameterSets(sps []byte, pps []byte) error {
+	_, spsErr := h.paramSets.Learn(sps)
+	_, ppsErr := h.paramSets.Learn(pps)
+	return errors.Join(spsErr, ppsErr)
+}
+
+// RequestParameterSets asks for a STAP-A with SPS/PPS ahead of the next access
+// unit. It has no effect unless the policy enables InjectOnDemand.
+func (h *H264Healer) RequestParameterSets() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.injector.arm(InjectOnDemand)
+}
+
+// SubscriberJoined tells the healer a new viewer started consuming the output,
+// so SPS/PPS go out ahead of the next access unit when InjectOnJoin is enabled.
+func (h *H264Healer) SubscriberJoined() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.injector.arm(InjectOnJoin)
+}
+
+// SDP describes the healed output. The payload type, the SSRC (when rewritten
+// with WithSSRC) and the parameter sets come from the healer; cfg provides the
+// rest. Parameter sets already set on cfg take precedence over the cache.
+func (h *H264Healer) SDP(cfg helper.SDPConfig) (string, error) {
+	h.mu.Lock()
+	cfg.PayloadType = h.payloadType
+	if h.rewriteSSRC {
+		cfg.SSRC = h.ssrc
+	}
+	h.mu.Unlock()
+
+	if len(cfg.SPS) == 0 || len(cfg.PPS) == 0 {
+		cfg.SPS, cfg.PPS = h.ParameterSets()
+	}
+
+	return helper.BuildSDP(cfg)
+}
+
+func (h *H264Healer) pushFUA(pkt *rtp.Packet) error {
+	// the slice header is parsed by the assembler with the decoded sets of
+	// the store, the fragment info does not need it
+	info, err := helper.RetrieveNaluInfo(pkt, nil, nil, nil)
+	if err != nil {
+		fuaErr := h.assembleFUA(h.reassembler.interrupt())
+		// the fragment cannot be placed, its NAL unit is lost
+		h.reassembler.lose(pkt)
+		h.markLost()
+		return errors.Join(err, fuaErr)
+	}
+	return h.assembleFUA(h.reassembler.push(info, time.Now()))
+}
+
+// assembleFUA feeds a NAL unit rebuilt by the reassembler, if any, to the
+// access unit assembler, flags the access units of the NAL units it dropped
+// and passes err through.
+func (h *H264Healer) assembleFUA(nalu *reassembledNALU, err error) error {
+	var learnErr error
+	if nalu != nil {
+		if !nalu.truncated {
+			// a damaged parameter set must not replace a good one
+			_, learnErr = h.paramSets.Learn(nalu.pkt.Payload)
+		}
+		h.assemble(nalu.pkt.Payload, &nalu.pkt.Header, nalu.pkt.Marker, nalu.truncated, len(nalu.source.seqs), nalu.source)
+	}
+	h.markLost()
+	return errors.Join(err, learnErr)
+}
+
+// markLost flags the access units missing a NAL unit the reassembler dropped,
+// so the keyframe gate and the GOP cache do not take them for a clean IDR.
+func (h *H264Healer) markLost() {
+	for _, lost := range h.reassembler.takeLost() {
+		h.assembler.markLost(lost)
+	}
+}
+
+// emitAccessUnit packetizes an access unit according to the configured MTU,
+// puts a STAP-A carrying SPS/PPS ahead of its slices when the injection policy
+// asks for it, and sets the marker bit on the last packet only. Access units
+// held back by the keyframe gate produce no packets.
+func (h *H264Healer) emitAccessUnit(au *AccessUnit) ([]*rtp.Packet, error) {
+	header := h.outputHeader(au)
+
+	now := time.Now()
+	admitted, opened := h.gate.admit(au, now)
+	if !admitted {
+		return nil, nil
+	}
+	if opened {
+		// the decoder restarts from this IDR: it needs the parameter sets
+		h.injector.force()
+	}
+
+	unit := outputUnit{au: au, header: header}
+	var (
+		stapA     *rtp.Packet
+		injectErr error
+	)
+	if h.injector.shouldInject(au, now) {
+		sps, pps := h.parameterSetsFor(au)
+		pkt, err := helper.GenSTAPPacket(sps, pps, header.Clone())
+		if err == nil {
+			h.injector.injected(now)
+			stapA = &pkt
+			unit.sps, unit.pps = sps, pps
+		} else {
+			injectErr = err
+		}
+	}
+
+	if h.gopCache != nil {
+		sps, pps := h.parameterSetsFor(au)
+		h.gopCache.Add(au, sps, pps)
+	}
+	h.emittedUnits = append(h.emittedUnits, unit)
+
+	out, err := packetizeAccessUnit(au, header, stapA, h.mtu)
+	out = h.stamp(out)
+	if h.seqMap != nil {
+		h.seqMap.recordUnit(au, out)
+	}
+	return out, errors.Join(injectErr, err)
+}
+
+// outputHeader returns the RTP header of the packets carrying au.
+func (h *H264Healer) outputHeader(au *AccessUnit) rtp.Header {
+	header := rtp.Header{
+		Version:     2,
+		PayloadType: h.payloadType,
+		SSRC:        au.SSRC,
+		Timestamp:   au.Timestamp,
+	}
+	if h.rewriteSSRC {
+		header.SSRC = h.ssrc
+	}
+	return header
+}
+
+// packetizeAccessUnit carries the NAL units of au, with stapA (when not nil)
+// right after the access unit delimiter, if any, so it precedes SEI messages
+// and every slice of the picture. The SPS/PPS of au that stapA carries are
+// left out; other parameter sets, such as a second PPS, are passed through.
+// Only the last packet has the marker bit.
+func packetizeAccessUnit(au *AccessUnit, header rtp.Header, stapA *rtp.Packet, mtu int) ([]*rtp.Packet, error) {
+	var (
+		out      []*rtp.Packet
+		errs     []error
+		injected = injectedSets(stapA)
+	)
+
+	for _, nalu := range au.NALUs {
+		nalType := nalu[0] & 0x1F
+		if carries(injected, nalu) {
+			continue
+		}
+
+		if stapA != nil && nalType != 9 {
+			out = append(out, stapA)
+			stapA = nil
+		}
+
+		pkts, err := packetize(nalu, header, mtu)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		out = append(out, pkts...)
+	}
+
+	if len(out) > 0 {
+		out[len(out)-1].Marker = true
+	}
+	return out, errors.Join(errs...)
+}
+
+// injectedSets returns the parameter sets carried by an injected STAP-A.
+func injectedSets(stapA *rtp.Packet) [][]byte {
+	if stapA == nil {
+		return nil
+	}
+	sets, _ := helper.SplitSTAPAPacket(stapA.Payload)
+	return sets
+}
+
+// carries reports whether nalu is one of the injected parameter sets.
+func carries(injected [][]byte, nalu []byte) bool {
+	return slices.ContainsFunc(injected, func(set []byte) bool { return bytes.Equal(set, nalu) })
+}
+
+// packetize carries one NAL unit as a single NAL unit packet, or as FU-A
+// fragments when the packet would exceed mtu bytes with its header. No packet
+// has the marker bit set.
+func packetize(nalu []byte, header rtp.Header, mtu int) ([]*rtp.Packet, error) {
+	pkt := &rtp.Packet{Header: header.Clone(), Payload: nalu}
+
+	headerBytes, err := pkt.Header.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if _, exceeds := helper.NaluExceedsMTU(headerBytes, pkt.Payload, mtu); !exceeds {
+		return []*rtp.Packet{pkt}, nil
+	}
+	// every fragment repeats the RTP header and adds the FU indicator and header
+	chunk := mtu - len(headerBytes) - 2
+	if chunk < 1 {
+		return nil, fmt.Errorf("%w: %d bytes leave no room for a fragment", helper.ErrInvalidMTU, mtu)
+	}
+	return helper.FragmentSingleNaluToFUAPackets(*pkt, chunk)
+}
+
+// assemble feeds a complete NAL unit, carried by src, to the access unit
+// assembler. incomplete flags a truncated or damaged NAL unit. packets is the
+// number of source packets it adds to the buffered ones. Completed units are
+// emitted and delivered to the OnAccessUnit callbacks by collect.
+func (h *H264Healer) assemble(nalu []byte, header *rtp.Header, marker bool, incomplete bool, packets int, src nalSource) {
+	units := h.assembler.push(nalu, header.Timestamp, header.SSRC, marker, incomplete, src)
+	h.completedUnits = append(h.completedUnits, units...)
+
+	if len(units) > 0 {
+		h.pendingPackets = 0
+	}
+	if h.assembler.Pending() {
+		h.pendingPackets += packets
+	}
+}
+
+// bufferedPackets counts the source packets the healer is holding on to.
+func (h *H264Healer) bufferedPackets() int {
+	return len(h.reassembler.fragments) + h.pendingPackets
+}
+
+// enforceBufferLimit drops the FU-A being reassembled, then the access unit
+// being assembled, until the healer holds at most maxBufferedPackets packets.
+func (h *H264Healer) enforceBufferLimit() error {
+	buffered := h.bufferedPackets()
+	if buffered <= h.maxBufferedPackets {
+		return nil
+	}
+
+	h.overflows.BufferedPackets++
+	h.reassembler.discard()
+	h.markLost()
+	if h.bufferedPackets() > h.maxBufferedPackets {
+		h.assembler.Discard()
+		h.pendingPackets = 0
+	}
+	return &helper.OverflowError{Limit: "buffered packets", Size: buffered, Max: h.maxBufferedPackets}
+}
+
+// parameterSetsFor returns the SPS/PPS referenced by the first slice of au,
+// falling back to the latest pair when the slice references unknown ids.
+func (h *H264Healer) parameterSetsFor(au *AccessUnit) (sps []byte, pps []byte) {
+	for _, nalu := range au.NALUs {
+		if nalType := nalu[0] & 0x1F; nalType == 1 || nalType == 5 {
+			if sps, pps, err := h.paramSets.ForSlice(nalu); err == nil {
+				return sps, pps
+			}
+			break
+		}
+	}
+	return h.paramSets.Latest()
+}
+
+func (h *H264Healer) stamp(pkts []*rtp.Packet) []*rtp.Packet {
+	for _, pkt := range pkts {
+		h.sequencer.Stamp(pkt)
+		if h.tap != nil {
+			// the mirror is best effort and never affects the healed output
+			_ = h.tap.WriteRTP(pkt)
+		}
+	}
+	return pkts
+}
@@ -0,0 +1,390 @@
+package healer
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/LacavaDev/mitra-rtp-healer/helper"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// testSPS is a progressive 1280x720 High profile SPS, log2_max_frame_num 4,
+// pic_order_cnt_type 0 with log2_max_pic_order_cnt_lsb 6; testPPS is PPS 0
+// referencing it.
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x6c, 0x80, 0x00, 0x00, 0x03, 0x00, 0x80, 0x00, 0x00, 0x1e, 0x07, 0x8c, 0x18, 0xcb}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+	testIDR = []byte{0x65, 0x88, 0x84, 0x00, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c}
+)
+
+// The slices of a three-slice IDR picture, first_mb_in_slice 0, 40 and 80,
+// and of the P picture that follows it.
+var (
+	testIDRSlices = [][]byte{
+		testIDR,
+		{0x65, 0x05, 0x22, 0x21, 0x00, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c},
+		{0x65, 0x02, 0x88, 0x88, 0x40, 0x06, 0x07, 0x08},
+	}
+	testSlice = []byte{0x61, 0x9a, 0x21, 0x00, 0x05, 0x06, 0x07, 0x08}
+)
+
+// padded returns nalu extended to size bytes of slice data.
+func padded(nalu []byte, size int) []byte {
+	out := append([]byte(nil), nalu...)
+	for len(out) < size {
+		out = append(out, byte(len(out)))
+	}
+	return out
+}
+
+// fragmented splits nalu into two FU-A payloads.
+func fragmented(nalu []byte) [][]byte {
+	half := len(nalu) / 2
+	indicator := nalu[0]&0xE0 | 28
+	return [][]byte{
+		append([]byte{indicator, 0x80 | nalu[0]&0x1F}, nalu[1:half]...),
+		append([]byte{indicator, 0x40 | nalu[0]&0x1F}, nalu[half:]...),
+	}
+}
+
+func TestMultiSliceIDRGetsOneSTAPA(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		trust          bool
+		markEverySlice bool
+	}{
+		{name: "marker on the last slice", trust: true},
+		{name: "marker on every slice", trust: false, markEverySlice: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			const mtu = 64
+			h := NewH264Healer(
+				WithMTU(mtu),
+				WithParameterSets(testSPS, testPPS),
+				WithTrustSourceMarker(tc.trust),
+			)
+
+			var (
+				seq uint16
+				out []*rtp.Packet
+			)
+			push := func(payload []byte, ts uint32, marker bool) {
+				seq++
+				pkt := &rtp.Packet{
+					Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: ts, SSRC: 1, Marker: marker},
+					Payload: payload,
+				}
+				pkts, err := h.Push(pkt)
+				if err != nil {
+					t.Fatalf("push %d: %v", seq, err)
+				}
+				out = append(out, pkts...)
+			}
+
+			// the middle slice comes as FU-A and is re-fragmented to the MTU
+			last := len(testIDRSlices) - 1
+			for i, slice := range testIDRSlices {
+				marker := i == last || tc.markEverySlice
+				if i != 1 {
+					push(slice, 3000, marker)
+					continue
+				}
+				fragments := fragmented(padded(slice, 150))
+				push(fragments[0], 3000, tc.markEverySlice)
+				push(fragments[1], 3000, marker)
+			}
+			push(testSlice, 6000, true)
+
+			var idr []*rtp.Packet
+			for _, pkt := range out {
+				if pkt.Timestamp == 3000 {
+					idr = append(idr, pkt)
+				}
+			}
+			if len(idr) < 2 {
+				t.Fatalf("got %d packets for the IDR picture", len(idr))
+			}
+
+			stapA := 0
+			for i, pkt := range idr {
+				nalType := pkt.Payload[0] & 0x1F
+				if nalType == 24 {
+					stapA++
+					if i != 0 {
+						t.Errorf("STAP-A at packet %d, want it before the first slice", i)
+					}
+				}
+				if pkt.Marker != (i == len(idr)-1) {
+					t.Errorf("packet %d of %d has marker %v", i, len(idr), pkt.Marker)
+				}
+				if pkt.MarshalSize() > mtu && nalType != 24 {
+					t.Errorf("packet %d is %d bytes, MTU %d", i, pkt.MarshalSize(), mtu)
+				}
+			}
+			if stapA != 1 {
+				t.Errorf("got %d STAP-A packets, want 1", stapA)
+			}
+			if got := idr[1].Payload; len(got) < len(testIDR) || got[1] != testIDR[1] {
+				t.Errorf("first packet after the STAP-A is %x, want the first slice", got)
+			}
+		})
+	}
+}
+
+// FuzzPush feeds the healer with packets described by data: a flags byte, a
+// length byte and that many payload bytes, repeated. Flag bit 0 is the marker
+// bit, bit 1 skips a sequence number, bit 2 starts a new timestamp and bit 3
+// switches the source SSRC.
+func FuzzPush(f *testing.F) {
+	record := func(flags byte, payload []byte) []byte {
+		return append([]byte{flags, byte(len(payload))}, payload...)
+	}
+	var stream []byte
+	stream = append(stream, record(0x04, testSPS)...)
+	stream = append(stream, record(0x00, testPPS)...)
+	stream = append(stream, record(0x01, testIDR)...)
+	stream = append(stream, record(0x04, append([]byte{0x7c, 0x85}, testIDR[1:6]...))...)
+	stream = append(stream, record(0x01, append([]byte{0x7c, 0x45}, testIDR[6:]...))...)
+	f.Add(stream)
+	f.Add(record(0x05, []byte{0x38, 0x00, 0x01, 0x5c}))
+	f.Add(record(0x05, []byte{0x78, 0x00, 0x01, 0x5c, 0x00, 0x01, 0x65}))
+	f.Add(record(0x03, []byte{0x7c, 0x45, 0x01}))
+
+	const mtu = 64
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := NewH264Healer(
+			WithMTU(mtu),
+			WithParameterSets(testSPS, testPPS),
+			WithSequenceMap(16),
+			WithGOPCache(8),
+			WithKeyframeGating(GateOnLoss|GateOnSSRCChange),
+			WithKeyframeRequestInterval(time.Nanosecond),
+		)
+
+		var (
+			seq  uint16
+			ts   uint32
+			ssrc uint32 = 1
+			out  []*rtp.Packet
+		)
+		for len(data) >= 2 {
+			flags, size := data[0], int(data[1])
+			data = data[2:]
+			size = min(size, len(data))
+			payload := data[:size]
+			data = data[size:]
+
+			seq++
+			if flags&0x02 != 0 {
+				seq++
+			}
+			if flags&0x04 != 0 {
+				ts += 3000
+			}
+			if flags&0x08 != 0 {
+				ssrc++
+			}
+			pkt := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: ts, SSRC: ssrc, Marker: flags&0x01 != 0},
+				Payload: payload,
+			}
+			pkts, _ := h.Push(pkt)
+			out = append(out, pkts...)
+		}
+
+		m := h.SequenceMap()
+		for _, pkt := range out {
+			if len(pkt.Payload) == 0 {
+				t.Fatalf("packet %d has no payload", pkt.SequenceNumber)
+			}
+			if nalType := pkt.Payload[0] & 0x1F; nalType != 24 && pkt.MarshalSize() > mtu {
+				t.Fatalf("packet %d of type %d is %d bytes, MTU %d", pkt.SequenceNumber, nalType, pkt.MarshalSize(), mtu)
+			}
+			if _, ok := m.Sources(pkt.SequenceNumber); !ok && len(out) <= 16 {
+				t.Fatalf("packet %d missing from the sequence map", pkt.SequenceNumber)
+			}
+			m.TranslateNACK(&rtcp.TransportLayerNack{Nacks: rtcp.NackPairsFromSequenceNumbers([]uint16{pkt.SequenceNumber})})
+		}
+	})
+}
+
+func TestInjectionKeepsOtherParameterSets(t *testing.T) {
+	// PPS 1 references SPS 0 too; the IDR uses PPS 0
+	pps1 := []byte{0x68, 0x53, 0x8f, 0x20}
+	h := NewH264Healer(WithSequenceMap(0))
+
+	var out []*rtp.Packet
+	for i, payload := range [][]byte{testSPS, testPPS, pps1, testIDR} {
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: uint16(10 + i), Timestamp: 3000, SSRC: 1, Marker: i == 3},
+			Payload: payload,
+		}
+		pkts, err := h.Push(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, pkts...)
+	}
+
+	if len(out) != 3 {
+		t.Fatalf("got %d packets, want STAP-A, PPS 1 and IDR", len(out))
+	}
+	sets, err := helper.SplitSTAPAPacket(out[0].Payload)
+	if err != nil || len(sets) != 2 || !bytes.Equal(sets[0], testSPS) || !bytes.Equal(sets[1], testPPS) {
+		t.Fatalf("first packet %x, want a STAP-A with SPS and PPS 0", out[0].Payload)
+	}
+	if !bytes.Equal(out[1].Payload, pps1) || !bytes.Equal(out[2].Payload, testIDR) {
+		t.Fatalf("got %x then %x, want PPS 1 then the IDR", out[1].Payload, out[2].Payload)
+	}
+
+	m := h.SequenceMap()
+	for i, want := range [][]uint16{nil, {12}, {13}} {
+		sources, ok := m.Sources(out[i].SequenceNumber)
+		if !ok || !slices.Equal(sources, want) {
+			t.Errorf("packet %d carries %v (%v), want %v", i, sources, ok, want)
+		}
+	}
+}
+
+func TestSalvagedNALUMarksAccessUnitIncomplete(t *testing.T) {
+	h := NewH264Healer(WithParameterSets(testSPS, testPPS), WithIncompletePolicy(SalvageIncomplete))
+	var aus []*AccessUnit
+	h.OnAccessUnit(func(au *AccessUnit) { aus = append(aus, au) })
+
+	// the middle fragment was flagged as damaged (F bit) by a middlebox
+	fragments := [][]byte{
+		append([]byte{0x7c, 0x85}, testIDR[1:4]...),
+		append([]byte{0xfc, 0x05}, testIDR[4:8]...),
+		append([]byte{0x7c, 0x45}, testIDR[8:]...),
+	}
+	for i, payload := range fragments {
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: uint16(i), Timestamp: 3000, SSRC: 1, Marker: i == len(fragments)-1},
+			Payload: payload,
+		}
+		if _, err := h.Push(pkt); err != nil && !errors.Is(err, helper.ErrForbiddenBitMismatch) {
+			t.Fatal(err)
+		}
+	}
+
+	if len(aus) != 1 {
+		t.Fatalf("got %d access units, want 1", len(aus))
+	}
+	if !aus[0].IsKeyframe || !aus[0].Incomplete {
+		t.Errorf("IsKeyframe %v, Incomplete %v; want an incomplete keyframe", aus[0].IsKeyframe, aus[0].Incomplete)
+	}
+	if nalu := aus[0].NALUs[0]; nalu[0]&0x80 == 0 {
+		t.Errorf("salvaged NAL unit %x does not have the F bit", nalu)
+	}
+}
+
+func TestDroppedNALUMarksAccessUnitIncomplete(t *testing.T) {
+	h := NewH264Healer(WithParameterSets(testSPS, testPPS), WithKeyframeGating(GateOnLoss))
+	var aus []*AccessUnit
+	h.OnAccessUnit(func(au *AccessUnit) { aus = append(aus, au) })
+
+	var (
+		seq uint16
+		out []*rtp.Packet
+	)
+	push := func(payload []byte, ts uint32, marker bool, lost bool) {
+		seq++
+		if lost {
+			return
+		}
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: ts, SSRC: 1, Marker: marker},
+			Payload: payload,
+		}
+		pkts, _ := h.Push(pkt)
+		out = append(out, pkts...)
+	}
+
+	// the first slice of the IDR loses its middle fragment and is discarded
+	first := padded(testIDRSlices[0], 30)
+	push(append([]byte{0x7c, 0x85}, first[1:10]...), 3000, false, false)
+	push(append([]byte{0x7c, 0x05}, first[10:20]...), 3000, false, true)
+	push(append([]byte{0x7c, 0x45}, first[20:]...), 3000, false, false)
+	push(testIDRSlices[1], 3000, false, false)
+	push(testIDRSlices[2], 3000, true, false)
+	if len(out) != 0 {
+		t.Fatalf("got %d packets for a partial IDR, want it held back by the gate", len(out))
+	}
+
+	for i, slice := range testIDRSlices {
+		push(slice, 6000, i == len(testIDRSlices)-1, false)
+	}
+
+	if len(aus) != 2 {
+		t.Fatalf("got %d access units, want 2", len(aus))
+	}
+	if !aus[0].IsKeyframe || !aus[0].Incomplete {
+		t.Errorf("partial IDR: IsKeyframe %v, Incomplete %v", aus[0].IsKeyframe, aus[0].Incomplete)
+	}
+	if aus[1].Incomplete {
+		t.Error("complete IDR flagged as Incomplete")
+	}
+	if len(out) == 0 || out[0].Timestamp != 6000 {
+		t.Error("the gate did not reopen on the complete IDR")
+	}
+}
+
+func TestReplayAfterKeyframeRequestKeepsTimestampsIncreasing(t *testing.T) {
+	h := NewH264Healer(WithParameterSets(testSPS, testPPS), WithGOPCache(0))
+	received := make(chan *rtp.Packet, 64)
+	sub := h.Subscribe(SinkFunc(func(pkt *rtp.Packet) error {
+		received <- pkt.Clone()
+		return nil
+	}))
+	defer sub.Close()
+
+	var seq uint16
+	push := func(payload []byte, ts uint32) {
+		seq++
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: ts, SSRC: 1, Marker: true},
+			Payload: payload,
+		}
+		if _, err := h.Push(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// receive waits for n packets and returns their timestamps
+	receive := func(n int) []uint32 {
+		var timestamps []uint32
+		for range n {
+			select {
+			case pkt := <-received:
+				timestamps = append(timestamps, pkt.Timestamp)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("got %d packets, want %d", len(timestamps), n)
+			}
+		}
+		return timestamps
+	}
+
+	push(testIDR, 3000)
+	push(testSlice, 6000)
+	push(testSlice, 9000)
+	// STAP-A and IDR, then the two P pictures
+	timestamps := receive(4)
+
+	sub.HandleRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: 1}})
+	// the replay: STAP-A, IDR and two P pictures
+	timestamps = append(timestamps, receive(4)...)
+	push(testSlice, 12000)
+	timestamps = append(timestamps, receive(1)...)
+
+	for i := 1; i < len(timestamps); i++ {
+		if int32(timestamps[i]-timestamps[i-1]) < 0 {
+			t.Fatalf("timestamps %v go back at packet %d", timestamps, i)
+		}
+	}
+	if timestamps[4] == timestamps[3] {
+		t.Errorf("timestamps %v: the replay reuses a timestamp already received", timestamps)
+	}
+}
@@ -0,0 +1,94 @@
+package healer
+
+import "time"
+
+// InjectionTrigger selects when the healer sends a STAP-A carrying SPS/PPS.
+// Triggers are bit flags and can be combined.
+type InjectionTrigger uint8
+
+const (
+	// InjectBeforeIDR injects once ahead of every IDR picture, however many
+	// slices it has and whether they arrived as single NAL units or FU-A.
+	InjectBeforeIDR InjectionTrigger = 1 << iota
+	// InjectPeriodic injects at the first access unit after Interval elapsed.
+	InjectPeriodic
+	// InjectOnJoin injects at the next access unit after SubscriberJoined.
+	InjectOnJoin
+	// InjectOnDemand injects at the next access unit after RequestParameterSets.
+	InjectOnDemand
+)
+
+// InjectionPolicy configures the SPS/PPS injection of a healer.
+type InjectionPolicy struct {
+	Triggers InjectionTrigger
+	// Interval is used by InjectPeriodic.
+	Interval time.Duration
+}
+
+// DefaultInjectionPolicy injects before every IDR, when a subscriber joins and on demand.
+func DefaultInjectionPolicy() InjectionPolicy {
+	return InjectionPolicy{Triggers: InjectBeforeIDR | InjectOnJoin | InjectOnDemand}
+}
+
+// injector decides, access unit by access unit, whether a STAP-A must go
+// out ahead of the first slice. An IDR picture split over several access units
+// (a camera marking every slice) is only injected once: a continuation starts
+// with first_mb_in_slice > 0 and keeps the timestamp of the previous unit.
+type injector struct {
+	policy InjectionPolicy
+
+	pending       bool
+	lastInjection time.Time
+	lastTimestamp uint32
+	hasTimestamp  bool
+}
+
+func newInjector(policy InjectionPolicy) *injector {
+	return &injector{policy: policy}
+}
+
+func (i *injector) enabled(trigger InjectionTrigger) bool {
+	return i.policy.Triggers&trigger != 0
+}
+
+// arm schedules an injection for the next access unit if trigger is enabled.
+func (i *injector) arm(trigger InjectionTrigger) {
+	if i.enabled(trigger) {
+		i.pending = true
+	}
+}
+
+// force schedules an injection for the next access unit, whatever the policy.
+func (i *injector) force() {
+	i.pending = true
+}
+
+// shouldInject reports whether a STAP-A must precede the slices of au. Access
+// units without slices never get one: the injection waits for the next picture.
+func (i *injector) shouldInject(au *AccessUnit, now time.Time) bool {
+	if !au.hasSlices() {
+		return false
+	}
+
+	newPicture := !i.hasTimestamp || au.Timestamp != i.lastTimestamp ||
+		(au.FirstSlice != nil && au.FirstSlice.FirstMbInSlice == 0)
+	i.lastTimestamp = au.Timestamp
+	i.hasTimestamp = true
+
+	if !newPicture {
+		return false
+	}
+	if au.IsKeyframe && i.enabled(InjectBeforeIDR) {
+		return true
+	}
+	if i.pending {
+		return true
+	}
+	return i.enabled(InjectPeriodic) && i.policy.Interval > 0 && now.Sub(i.lastInjection) >= i.policy.Interval
+}
+
+// injected records a successful injection.
+func (i *injector) injected(now time.Time) {
+	i.pending = false
+	i.lastInjection = now
+}
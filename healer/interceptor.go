@@ -0,0 +1,155 @@
+package healer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/LacavaDev/mitra-rtp-healer/helper"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// InterceptorFactory builds an Interceptor for every PeerConnection. Register
+// it in an interceptor.Registry after the default interceptors: the last
+// registered interceptor sees the packets first, so NACK responders and
+// congestion control then work on the healed packets.
+type InterceptorFactory struct {
+	opts []Option
+
+	mu    sync.Mutex
+	onNew func(id string, ssrc uint32, h *H264Healer)
+}
+
+// NewInterceptorFactory creates a factory configuring every stream healer
+// with opts. The payload type of each stream is taken from its binding.
+// WithJitterBuffer is rejected: nothing would Poll the healers, so packets
+// would wait for the next write.
+func NewInterceptorFactory(opts ...Option) (*InterceptorFactory, error) {
+	if NewH264Healer(opts...).jitter != nil {
+		return nil, fmt.Errorf("%w: WithJitterBuffer in an interceptor", helper.ErrUnsupportedOption)
+	}
+	return &InterceptorFactory{opts: opts}, nil
+}
+
+// OnNewHealer registers f, called with the interceptor id and the SSRC of
+// every H.264 stream bound, to reach its healer (Stats, OnKeyframeRequest...).
+func (f *InterceptorFactory) OnNewHealer(fn func(id string, ssrc uint32, h *H264Healer)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onNew = fn
+}
+
+// NewInterceptor implements interceptor.Factory.
+func (f *InterceptorFactory) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &Interceptor{
+		id:      id,
+		opts:    f.opts,
+		onNew:   f.onNew,
+		healers: make(map[uint32]*H264Healer),
+	}, nil
+}
+
+// Interceptor heals the outgoing H.264 streams of a PeerConnection: every
+// packet written to an H.264 track goes through its own H264Healer, which
+// re-fragments to the MTU, injects SPS/PPS and renumbers the stream. Other
+// streams are left untouched.
+//
+// The PLI and FIR read by the application (RTPSender.ReadRTCP) are passed to
+// the healer of the stream they target, see H264Healer.HandleRTCP. The GOP
+// cache is not replayed: the healed packets are not queued per viewer.
+type Interceptor struct {
+	interceptor.NoOp
+
+	id    string
+	opts  []Option
+	onNew func(id string, ssrc uint32, h *H264Healer)
+
+	mu      sync.Mutex
+	healers map[uint32]*H264Healer
+}
+
+// Healer returns the healer of the local stream with the given SSRC.
+func (i *Interceptor) Healer(ssrc uint32) (*H264Healer, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	h, ok := i.healers[ssrc]
+	return h, ok
+}
+
+// BindRTCPReader implements interceptor.Interceptor.
+func (i *Interceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err != nil {
+			return n, attr, err
+		}
+		if attr == nil {
+			attr = make(interceptor.Attributes)
+		}
+		pkts, err := attr.GetRTCPPackets(b[:n])
+		if err != nil {
+			return n, attr, err
+		}
+
+		i.mu.Lock()
+		healers := make(map[uint32]*H264Healer, len(i.healers))
+		for ssrc, h := range i.healers {
+			healers[ssrc] = h
+		}
+		i.mu.Unlock()
+
+		for ssrc, h := range healers {
+			h.keyframeRequested(keyframeRequests(pkts, func(media uint32) bool { return media == ssrc }))
+		}
+		return n, attr, nil
+	})
+}
+
+// BindLocalStream implements interceptor.Interceptor.
+func (i *Interceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.EqualFold(info.MimeType, webrtc.MimeTypeH264) {
+		return writer
+	}
+
+	opts := append(i.opts[:len(i.opts):len(i.opts)], WithPayloadType(info.PayloadType))
+	h := NewH264Healer(opts...)
+
+	i.mu.Lock()
+	i.healers[info.SSRC] = h
+	i.mu.Unlock()
+	if i.onNew != nil {
+		i.onNew(i.id, info.SSRC, h)
+	}
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		// the healer keeps NAL units across calls, the caller may reuse payload
+		pkt := &rtp.Packet{Header: header.Clone(), Payload: append([]byte(nil), payload...)}
+		pkts, healErr := h.Push(pkt)
+
+		var (
+			written  int
+			writeErr error
+		)
+		for _, out := range pkts {
+			n, err := writer.Write(&out.Header, out.Payload, attributes)
+			written += n
+			if err != nil {
+				writeErr = err
+				break
+			}
+		}
+		return written, errors.Join(writeErr, healErr)
+	})
+}
+
+// UnbindLocalStream implements interceptor.Interceptor.
+func (i *Interceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.healers, info.SSRC)
+}
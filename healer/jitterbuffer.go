@@ -0,0 +1,275 @@
+package healer
+
+import (
+	"math"
+	"time"
+
+	"github.com/LacavaDev/mitra-rtp-healer/helper"
+	"github.com/pion/rtp"
+)
+
+const (
+	// jitterHistory is how many emitted sequence numbers are remembered to
+	// tell a duplicate from a packet that arrived after it was given up on.
+	jitterHistory = 1024
+	// resyncDistance is the sequence number jump treated as a restart of the
+	// source rather than as loss or reordering.
+	resyncDistance = 3000
+)
+
+// JitterBufferConfig sizes the reordering window of a JitterBuffer. A packet
+// is held until the packets before it arrived, for at most Latency and while
+// fewer than MaxPackets packets are waiting.
+type JitterBufferConfig struct {
+	MaxPackets int
+	Latency    time.Duration
+	// Adaptive lowers the latency to four times the measured interarrival
+	// jitter (RFC 3550 A.8), never below MinLatency nor above Latency.
+	Adaptive   bool
+	MinLatency time.Duration
+	// ClockRate is the RTP clock rate used to measure jitter, 90000 for H.264.
+	ClockRate uint32
+}
+
+// DefaultJitterBufferConfig holds up to 128 packets for up to 200 ms.
+func DefaultJitterBufferConfig() JitterBufferConfig {
+	return JitterBufferConfig{
+		MaxPackets: 128,
+		Latency:    200 * time.Millisecond,
+		MinLatency: 20 * time.Millisecond,
+		ClockRate:  90000,
+	}
+}
+
+// JitterStats counts what the jitter buffer did since it was created.
+type JitterStats struct {
+	Emitted uint64
+	// Reordered counts packets that arrived after a packet with a higher
+	// sequence number and were put back in order.
+	Reordered uint64
+	// Duplicates counts packets received twice; the copy is dropped.
+	Duplicates uint64
+	// Late counts packets that arrived after the buffer stopped waiting for them.
+	Late uint64
+	// Lost counts sequence numbers skipped when the window ran out.
+	Lost uint64
+	// Resyncs counts sequence number jumps handled as a source restart.
+	Resyncs uint64
+	// Jitter is the measured interarrival jitter and Latency the current
+	// reordering window.
+	Jitter  time.Duration
+	Latency time.Duration
+}
+
+// JitterBuffer puts RTP packets back in sequence number order before they
+// reach the healer. Sequence numbers are extended to 32 bits so ordering
+// survives wrap-arounds. It is not safe for concurrent use; the healer
+// serialises access.
+type JitterBuffer struct {
+	cfg   JitterBufferConfig
+	stats JitterStats
+
+	// packets are sorted with helper.SortRTPPacketsBySequence; they always
+	// span less than resyncDistance sequence numbers.
+	packets  []*rtp.Packet
+	arrivals map[uint16]time.Time
+
+	started bool
+	// primed is set once the first packets waited for the window, so the
+	// start of the stream is reordered too.
+	primed  bool
+	next    uint32
+	highest uint32
+	history [jitterHistory]uint32
+
+	jitter        float64
+	lastArrival   time.Time
+	lastTimestamp uint32
+	measured      bool
+	samples       int
+}
+
+// NewJitterBuffer creates a jitter buffer. Zero fields of cfg take their value
+// from DefaultJitterBufferConfig.
+func NewJitterBuffer(cfg JitterBufferConfig) *JitterBuffer {
+	defaults := DefaultJitterBufferConfig()
+	if cfg.MaxPackets <= 0 {
+		cfg.MaxPackets = defaults.MaxPackets
+	}
+	cfg.MaxPackets = min(cfg.MaxPackets, resyncDistance)
+	if cfg.Latency <= 0 {
+		cfg.Latency = defaults.Latency
+	}
+	if cfg.MinLatency <= 0 {
+		cfg.MinLatency = min(defaults.MinLatency, cfg.Latency)
+	}
+	if cfg.ClockRate == 0 {
+		cfg.ClockRate = defaults.ClockRate
+	}
+	return &JitterBuffer{cfg: cfg, arrivals: make(map[uint16]time.Time)}
+}
+
+// Push adds a packet received at now and returns the packets that can be
+// released in order.
+func (j *JitterBuffer) Push(pkt *rtp.Packet, now time.Time) []*rtp.Packet {
+	var out []*rtp.Packet
+
+	if !j.started {
+		j.start(pkt.SequenceNumber)
+	}
+	delta := int32(int16(pkt.SequenceNumber - uint16(j.next)))
+	if delta > resyncDistance || delta < -resyncDistance {
+		out = j.Flush()
+		j.start(pkt.SequenceNumber)
+		j.stats.Resyncs++
+		delta = 0
+	}
+	ext := uint32(int64(j.next) + int64(delta))
+
+	if delta < 0 && !j.primed {
+		// nothing was released yet: the stream simply starts earlier
+		j.next = ext
+		delta = 0
+	}
+	if delta < 0 {
+		if j.history[ext%jitterHistory] == ext+1 {
+			j.stats.Duplicates++
+		} else {
+			j.stats.Late++
+		}
+		return out
+	}
+	if _, ok := j.arrivals[pkt.SequenceNumber]; ok {
+		j.stats.Duplicates++
+		return out
+	}
+
+	if ext < j.highest {
+		j.stats.Reordered++
+	} else {
+		j.measure(pkt, now)
+		j.highest = ext
+	}
+
+	j.packets = helper.SortRTPPacketsBySequence(append(j.packets, pkt))
+	j.arrivals[pkt.SequenceNumber] = now
+	return append(out, j.release(now)...)
+}
+
+// Poll releases the packets that waited longer than the latency for a missing
+// one. Call it periodically so packets leave on time when the source pauses.
+func (j *JitterBuffer) Poll(now time.Time) []*rtp.Packet {
+	return j.release(now)
+}
+
+// Flush releases every buffered packet in order, giving up on the missing ones.
+func (j *JitterBuffer) Flush() []*rtp.Packet {
+	var out []*rtp.Packet
+	j.primed = true
+	for len(j.packets) > 0 {
+		j.skipToHead()
+		out = append(out, j.drain()...)
+	}
+	return out
+}
+
+// Len returns the number of buffered packets.
+func (j *JitterBuffer) Len() int {
+	return len(j.packets)
+}
+
+// Stats returns the counters of the jitter buffer.
+func (j *JitterBuffer) Stats() JitterStats {
+	stats := j.stats
+	stats.Jitter = time.Duration(j.jitter / float64(j.cfg.ClockRate) * float64(time.Second))
+	stats.Latency = j.latency()
+	return stats
+}
+
+func (j *JitterBuffer) start(seq uint16) {
+	// one cycle of headroom keeps packets older than the first one positive
+	ext := 1<<16 | uint32(seq)
+	j.started = true
+	j.primed = false
+	j.next = ext
+	j.highest = ext
+}
+
+// release drains the in-order packets, skipping missing ones while the window
+// is exceeded.
+func (j *JitterBuffer) release(now time.Time) []*rtp.Packet {
+	if !j.primed {
+		if len(j.packets) == 0 || (len(j.packets) <= j.cfg.MaxPackets && !j.expired(now)) {
+			return nil
+		}
+		j.primed = true
+	}
+	out := j.drain()
+	for len(j.packets) > 0 && (len(j.packets) > j.cfg.MaxPackets || j.expired(now)) {
+		j.skipToHead()
+		out = append(out, j.drain()...)
+	}
+	return out
+}
+
+// drain pops the packets following the last emitted one without a gap.
+func (j *JitterBuffer) drain() []*rtp.Packet {
+	var out []*rtp.Packet
+	for len(j.packets) > 0 && j.packets[0].SequenceNumber == uint16(j.next) {
+		pkt := j.packets[0]
+		j.packets[0] = nil
+		j.packets = j.packets[1:]
+		delete(j.arrivals, pkt.SequenceNumber)
+
+		j.history[j.next%jitterHistory] = j.next + 1
+		j.next++
+		j.stats.Emitted++
+		out = append(out, pkt)
+	}
+	return out
+}
+
+// skipToHead gives up on the sequence numbers missing before the first buffered packet.
+func (j *JitterBuffer) skipToHead() {
+	lost := uint16(j.packets[0].SequenceNumber - uint16(j.next))
+	j.stats.Lost += uint64(lost)
+	j.next += uint32(lost)
+}
+
+// expired reports whether a buffered packet waited longer than the latency.
+func (j *JitterBuffer) expired(now time.Time) bool {
+	latency := j.latency()
+	for _, arrival := range j.arrivals {
+		if now.Sub(arrival) >= latency {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *JitterBuffer) latency() time.Duration {
+	// the estimate needs a few pictures before it can be trusted
+	if !j.cfg.Adaptive || j.samples < 16 {
+		return j.cfg.Latency
+	}
+	jitter := time.Duration(4 * j.jitter / float64(j.cfg.ClockRate) * float64(time.Second))
+	return min(max(jitter, j.cfg.MinLatency), j.cfg.Latency)
+}
+
+// measure updates the interarrival jitter with the first packet of each
+// timestamp: the packets of one picture are sent in a burst and would only
+// measure the sender pacing.
+func (j *JitterBuffer) measure(pkt *rtp.Packet, now time.Time) {
+	if j.measured && pkt.Timestamp == j.lastTimestamp {
+		return
+	}
+	if j.measured {
+		elapsed := now.Sub(j.lastArrival).Seconds() * float64(j.cfg.ClockRate)
+		advance := float64(int32(pkt.Timestamp - j.lastTimestamp))
+		j.jitter += (math.Abs(elapsed-advance) - j.jitter) / 16
+		j.samples++
+	}
+	j.lastArrival = now
+	j.lastTimestamp = pkt.Timestamp
+	j.measured = true
+}
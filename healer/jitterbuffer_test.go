@@ -0,0 +1,180 @@
+package healer
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/LacavaDev/mitra-rtp-healer/helper"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+var jitterStart = time.Unix(1000, 0)
+
+func jitterPacket(seq uint16) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: uint32(seq) * 3000}}
+}
+
+// pushAll pushes one packet per sequence number at now and returns the
+// sequence numbers released.
+func pushAll(j *JitterBuffer, now time.Time, seqs ...uint16) []uint16 {
+	var out []uint16
+	for _, seq := range seqs {
+		out = append(out, sequences(j.Push(jitterPacket(seq), now))...)
+	}
+	return out
+}
+
+func sequences(pkts []*rtp.Packet) []uint16 {
+	var seqs []uint16
+	for _, pkt := range pkts {
+		seqs = append(seqs, pkt.SequenceNumber)
+	}
+	return seqs
+}
+
+func checkSequences(t *testing.T, what string, got []uint16, want ...uint16) {
+	t.Helper()
+	if !slices.Equal(got, want) {
+		t.Errorf("%s released %v, want %v", what, got, want)
+	}
+}
+
+func newTestJitterBuffer() *JitterBuffer {
+	return NewJitterBuffer(JitterBufferConfig{MaxPackets: 8, Latency: 100 * time.Millisecond})
+}
+
+func TestJitterBufferPollTiming(t *testing.T) {
+	j := newTestJitterBuffer()
+	checkSequences(t, "Push", pushAll(j, jitterStart, 10, 11))
+	checkSequences(t, "Poll before the latency", sequences(j.Poll(jitterStart.Add(99*time.Millisecond))))
+	checkSequences(t, "Poll at the latency", sequences(j.Poll(jitterStart.Add(100*time.Millisecond))), 10, 11)
+
+	// once primed, in-order packets leave at once
+	checkSequences(t, "Push after priming", pushAll(j, jitterStart.Add(110*time.Millisecond), 12), 12)
+	if j.Len() != 0 {
+		t.Errorf("Len = %d, want 0", j.Len())
+	}
+}
+
+func TestJitterBufferReordering(t *testing.T) {
+	j := newTestJitterBuffer()
+	checkSequences(t, "Push", pushAll(j, jitterStart, 10, 12, 11))
+	checkSequences(t, "Poll", sequences(j.Poll(jitterStart.Add(100*time.Millisecond))), 10, 11, 12)
+
+	now := jitterStart.Add(120 * time.Millisecond)
+	checkSequences(t, "Push of 14", pushAll(j, now, 14))
+	checkSequences(t, "Push of 13", pushAll(j, now, 13), 13, 14)
+
+	if stats := j.Stats(); stats.Reordered != 2 || stats.Emitted != 5 || stats.Lost != 0 {
+		t.Errorf("stats %+v, want 2 reordered, 5 emitted, none lost", stats)
+	}
+}
+
+func TestJitterBufferStartsEarlierBeforePriming(t *testing.T) {
+	j := newTestJitterBuffer()
+	pushAll(j, jitterStart, 11, 10)
+	checkSequences(t, "Poll", sequences(j.Poll(jitterStart.Add(100*time.Millisecond))), 10, 11)
+	if stats := j.Stats(); stats.Late != 0 || stats.Lost != 0 {
+		t.Errorf("stats %+v, want nothing late or lost", stats)
+	}
+}
+
+func TestJitterBufferDuplicates(t *testing.T) {
+	j := newTestJitterBuffer()
+	// a copy of a buffered packet
+	pushAll(j, jitterStart, 10, 11, 11)
+	checkSequences(t, "Poll", sequences(j.Poll(jitterStart.Add(100*time.Millisecond))), 10, 11)
+	// a copy of a released packet
+	checkSequences(t, "Push of a released packet", pushAll(j, jitterStart.Add(110*time.Millisecond), 10))
+
+	if stats := j.Stats(); stats.Duplicates != 2 || stats.Late != 0 || stats.Emitted != 2 {
+		t.Errorf("stats %+v, want 2 duplicates, none late, 2 emitted", stats)
+	}
+}
+
+func TestJitterBufferWrapAround(t *testing.T) {
+	j := newTestJitterBuffer()
+	pushAll(j, jitterStart, 65534, 0, 65535)
+	checkSequences(t, "Poll", sequences(j.Poll(jitterStart.Add(100*time.Millisecond))), 65534, 65535, 0)
+
+	now := jitterStart.Add(120 * time.Millisecond)
+	checkSequences(t, "Push of 2", pushAll(j, now, 2))
+	checkSequences(t, "Push of 1", pushAll(j, now, 1), 1, 2)
+	// a late copy from before the wrap is still recognised
+	checkSequences(t, "Push of 65535", pushAll(j, now, 65535))
+
+	if stats := j.Stats(); stats.Reordered != 2 || stats.Duplicates != 1 || stats.Resyncs != 0 {
+		t.Errorf("stats %+v, want 2 reordered, 1 duplicate, no resync", stats)
+	}
+}
+
+func TestJitterBufferLateAndLost(t *testing.T) {
+	j := newTestJitterBuffer()
+	pushAll(j, jitterStart, 1)
+	checkSequences(t, "Poll", sequences(j.Poll(jitterStart.Add(100*time.Millisecond))), 1)
+
+	// 2 and 3 are given up on once 4 waited for the latency
+	now := jitterStart.Add(200 * time.Millisecond)
+	checkSequences(t, "Push of 4", pushAll(j, now, 4))
+	checkSequences(t, "Poll before the latency", sequences(j.Poll(now.Add(50*time.Millisecond))))
+	checkSequences(t, "Poll at the latency", sequences(j.Poll(now.Add(100*time.Millisecond))), 4)
+	checkSequences(t, "Push of 3", pushAll(j, now.Add(150*time.Millisecond), 3))
+
+	if stats := j.Stats(); stats.Lost != 2 || stats.Late != 1 || stats.Duplicates != 0 {
+		t.Errorf("stats %+v, want 2 lost, 1 late, no duplicate", stats)
+	}
+}
+
+func TestJitterBufferMaxPackets(t *testing.T) {
+	j := NewJitterBuffer(JitterBufferConfig{MaxPackets: 2, Latency: time.Second})
+	pushAll(j, jitterStart, 1)
+	checkSequences(t, "Poll", sequences(j.Poll(jitterStart.Add(time.Second))), 1)
+
+	// 2 is missing: the third packet waiting exceeds the window
+	now := jitterStart.Add(1100 * time.Millisecond)
+	checkSequences(t, "Push of 3 and 4", pushAll(j, now, 3, 4))
+	checkSequences(t, "Push of 5", pushAll(j, now, 5), 3, 4, 5)
+	if stats := j.Stats(); stats.Lost != 1 {
+		t.Errorf("stats %+v, want 1 lost", stats)
+	}
+}
+
+func TestJitterBufferResync(t *testing.T) {
+	j := newTestJitterBuffer()
+	pushAll(j, jitterStart, 100)
+	checkSequences(t, "Poll", sequences(j.Poll(jitterStart.Add(100*time.Millisecond))), 100)
+
+	// 102 waits for 101 when the source restarts far away: it is flushed
+	// and the new sequence waits for the window again
+	now := jitterStart.Add(200 * time.Millisecond)
+	checkSequences(t, "Push of 102", pushAll(j, now, 102))
+	checkSequences(t, "Push of 9000", pushAll(j, now, 9000), 102)
+	checkSequences(t, "Push of 8999", pushAll(j, now, 8999))
+	checkSequences(t, "Poll", sequences(j.Poll(now.Add(100*time.Millisecond))), 8999, 9000)
+
+	if stats := j.Stats(); stats.Resyncs != 1 || stats.Lost != 1 || stats.Late != 0 {
+		t.Errorf("stats %+v, want 1 resync, 1 lost, none late", stats)
+	}
+}
+
+func TestJitterBufferFlush(t *testing.T) {
+	j := newTestJitterBuffer()
+	pushAll(j, jitterStart, 5, 7, 8)
+	checkSequences(t, "Flush", sequences(j.Flush()), 5, 7, 8)
+	if stats := j.Stats(); stats.Lost != 1 || j.Len() != 0 {
+		t.Errorf("stats %+v, Len %d, want 1 lost and nothing buffered", stats, j.Len())
+	}
+}
+
+func TestJitterBufferRejectedWithoutPoll(t *testing.T) {
+	jitter := WithJitterBuffer(DefaultJitterBufferConfig())
+	if _, err := NewHealingTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "stream", jitter); !errors.Is(err, helper.ErrUnsupportedOption) {
+		t.Errorf("NewHealingTrack: got %v, want ErrUnsupportedOption", err)
+	}
+	if _, err := NewInterceptorFactory(jitter); !errors.Is(err, helper.ErrUnsupportedOption) {
+		t.Errorf("NewInterceptorFactory: got %v, want ErrUnsupportedOption", err)
+	}
+}
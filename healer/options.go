@@ -0,0 +1,153 @@
+package healer
+
+import "time"
+
+// Option configures an H264Healer at construction time.
+type Option func(*H264Healer)
+
+// WithMTU sets the maximum size of an output RTP packet, header included. NAL
+// units that do not fit are re-fragmented into FU-A packets.
+func WithMTU(mtu int) Option {
+	return func(h *H264Healer) {
+		if mtu > 0 {
+			h.mtu = mtu
+		}
+	}
+}
+
+// WithPayloadType sets the RTP payload type written on every output packet.
+func WithPayloadType(pt uint8) Option {
+	return func(h *H264Healer) {
+		h.payloadType = pt
+	}
+}
+
+// WithSSRC rewrites the SSRC of every output packet. By default the source SSRC is kept.
+func WithSSRC(ssrc uint32) Option {
+	return func(h *H264Healer) {
+		h.ssrc = ssrc
+		h.rewriteSSRC = true
+	}
+}
+
+// WithParameterSets seeds the parameter-set store, usually from the
+// sprop-parameter-sets of the RTSP DESCRIBE response, so the first IDR can be
+// decoded right away. Invalid or empty sets are ignored.
+func WithParameterSets(sps []byte, pps []byte) Option {
+	return func(h *H264Healer) {
+		_ = h.SetParameterSets(sps, pps)
+	}
+}
+
+// WithTap mirrors the complete healed output to t. Use NewUDPTap to reproduce
+// the old behaviour of sending to a local port for ffplay.
+func WithTap(t Tap) Option {
+	return func(h *H264Healer) {
+		h.tap = t
+	}
+}
+
+// WithInjectionPolicy replaces DefaultInjectionPolicy.
+func WithInjectionPolicy(policy InjectionPolicy) Option {
+	return func(h *H264Healer) {
+		h.injector = newInjector(policy)
+	}
+}
+
+// WithTrustSourceMarker selects whether the source marker bit closes an access
+// unit (the default). Pass false for cameras that set it on every slice or
+// fragment; the healer then relies on its own boundary detection. Either way
+// the output marker is set on the last packet of each access unit only.
+func WithTrustSourceMarker(trust bool) Option {
+	return func(h *H264Healer) {
+		h.assembler.TrustMarker = trust
+	}
+}
+
+// WithReassemblyTimeout bounds how long a FU-A NAL unit may wait for its end
+// fragment; the timeout is checked as packets arrive. Zero disables it.
+func WithReassemblyTimeout(timeout time.Duration) Option {
+	return func(h *H264Healer) {
+		h.reassembler.timeout = timeout
+	}
+}
+
+// WithIncompletePolicy selects what happens to a FU-A NAL unit with missing
+// fragments, or with a fragment flagged by the F bit. The default is
+// DiscardIncomplete.
+func WithIncompletePolicy(policy IncompletePolicy) Option {
+	return func(h *H264Healer) {
+		h.reassembler.policy = policy
+	}
+}
+
+// WithMaxNaluSize caps the size of a NAL unit rebuilt from FU-A fragments.
+// Larger NAL units are dropped with a *helper.OverflowError. The default is
+// helper.DefaultMaxNaluSize.
+func WithMaxNaluSize(size int) Option {
+	return func(h *H264Healer) {
+		if size > 0 {
+			h.reassembler.maxNaluSize = size
+		}
+	}
+}
+
+// WithMaxBufferedPackets caps how many source packets the healer holds while
+// reassembling FU-A and access units. Buffered data is dropped with a
+// *helper.OverflowError past the limit. The default is
+// helper.DefaultMaxBufferedPackets.
+func WithMaxBufferedPackets(packets int) Option {
+	return func(h *H264Healer) {
+		if packets > 0 {
+			h.maxBufferedPackets = packets
+		}
+	}
+}
+
+// WithJitterBuffer puts incoming packets back in sequence number order before
+// healing them. Packets are then released with up to cfg.Latency of delay;
+// call Poll periodically so they also leave while the source is silent.
+// HealingTrack and the interceptor do not poll and reject this option.
+func WithJitterBuffer(cfg JitterBufferConfig) Option {
+	return func(h *H264Healer) {
+		h.jitter = NewJitterBuffer(cfg)
+	}
+}
+
+// WithKeyframeGating holds back the access units a decoder cannot use: after
+// each enabled trigger, nothing is sent until a complete IDR, which always gets
+// SPS/PPS injected ahead of it. Register OnKeyframeRequest to ask the source
+// for that IDR. Gating is disabled by default.
+func WithKeyframeGating(triggers GateTrigger) Option {
+	return func(h *H264Healer) {
+		h.gate.triggers = triggers
+	}
+}
+
+// WithKeyframeRequestInterval sets the minimum time between two keyframe
+// requests sent upstream, DefaultKeyframeRequestInterval by default, so a
+// flood of PLIs does not reach the camera.
+func WithKeyframeRequestInterval(interval time.Duration) Option {
+	return func(h *H264Healer) {
+		if interval > 0 {
+			h.gate.interval = interval
+		}
+	}
+}
+
+// WithSequenceMap remembers the last size output packets and the source
+// packets they carry, see SequenceMap. Zero selects DefaultSequenceMapSize.
+func WithSequenceMap(size int) Option {
+	return func(h *H264Healer) {
+		h.seqMap = NewSequenceMap(size)
+	}
+}
+
+// WithGOPCache keeps the current group of pictures, up to maxAccessUnits
+// access units, so Subscribe can replay it to late joiners. Zero selects
+// DefaultGOPCacheSize.
+func WithGOPCache(maxAccessUnits int) Option {
+	return func(h *H264Healer) {
+		h.gopCache = NewGOPCache(maxAccessUnits)
+	}
+}
@@ -0,0 +1,161 @@
+package healer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
+	"github.com/LacavaDev/mitra-rtp-healer/helper"
+)
+
+// ErrUnknownParameterSet is returned when a slice references a PPS, or a PPS
+// references an SPS, that has not been seen yet.
+var ErrUnknownParameterSet = errors.New("unknown parameter set id")
+
+// ParameterSetStore keeps every SPS and PPS seen on a stream, keyed by
+// seq_parameter_set_id and pic_parameter_set_id, so cameras using several PPS
+// ids get the exact set each picture references. It is safe for concurrent use.
+//
+// Returned slices are shared with the store and must not be modified.
+type ParameterSetStore struct {
+	mu sync.RWMutex
+
+	sps       map[uint32][]byte
+	pps       map[uint32][]byte
+	parsedSPS map[uint32]*healerTypes.SPS
+	parsedPPS map[uint32]*healerTypes.PPS
+
+	latestSPS []byte
+	latestPPS []byte
+}
+
+// NewParameterSetStore creates an empty store.
+func NewParameterSetStore() *ParameterSetStore {
+	return &ParameterSetStore{
+		sps:       make(map[uint32][]byte),
+		pps:       make(map[uint32][]byte),
+		parsedSPS: make(map[uint32]*healerTypes.SPS),
+		parsedPPS: make(map[uint32]*healerTypes.PPS),
+	}
+}
+
+// Learn records nalu when it is an SPS or a PPS and reports whether it was one.
+// Any other NAL type is ignored.
+func (s *ParameterSetStore) Learn(nalu []byte) (bool, error) {
+	if len(nalu) < 1 {
+		return false, &helper.PayloadError{Length: 0, Needed: 1}
+	}
+
+	switch nalu[0] & 0x1F {
+	case 7:
+		id, err := helper.SPSID(nalu)
+		if err != nil {
+			return true, err
+		}
+		set := append([]byte(nil), nalu...)
+		// an SPS the full parser rejects is still injected, only its details are unknown
+		parsed, _ := helper.ParseSPS(set)
+
+		s.mu.Lock()
+		s.sps[id] = set
+		s.latestSPS = set
+		if parsed != nil {
+			s.parsedSPS[id] = parsed
+		} else {
+			delete(s.parsedSPS, id)
+		}
+		s.mu.Unlock()
+		return true, nil
+	case 8:
+		id, _, err := helper.PPSIDs(nalu)
+		if err != nil {
+			return true, err
+		}
+		set := append([]byte(nil), nalu...)
+		parsed, _ := helper.ParsePPS(set)
+
+		s.mu.Lock()
+		s.pps[id] = set
+		s.latestPPS = set
+		if parsed != nil {
+			s.parsedPPS[id] = parsed
+		} else {
+			delete(s.parsedPPS, id)
+		}
+		s.mu.Unlock()
+		return true, nil
+	}
+	return false, nil
+}
+
+// ForPPS returns the PPS with ppsID and the SPS it references.
+func (s *ParameterSetStore) ForPPS(ppsID uint32) (sps []byte, pps []byte, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pps, ok := s.pps[ppsID]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: PPS %d", ErrUnknownParameterSet, ppsID)
+	}
+	_, spsID, err := helper.PPSIDs(pps)
+	if err != nil {
+		return nil, nil, err
+	}
+	sps, ok = s.sps[spsID]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: SPS %d", ErrUnknownParameterSet, spsID)
+	}
+	return sps, pps, nil
+}
+
+// ForSlice returns the SPS/PPS pair referenced by a coded slice.
+func (s *ParameterSetStore) ForSlice(slice []byte) (sps []byte, pps []byte, err error) {
+	ppsID, err := helper.SlicePPSID(slice)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.ForPPS(ppsID)
+}
+
+// ParsedSPS returns the decoded SPS with id, when it was seen and could be parsed.
+func (s *ParameterSetStore) ParsedSPS(id uint32) (*healerTypes.SPS, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sps, ok := s.parsedSPS[id]
+	return sps, ok
+}
+
+// ParsedPPS returns the decoded PPS with id, when it was seen and could be parsed.
+func (s *ParameterSetStore) ParsedPPS(id uint32) (*healerTypes.PPS, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pps, ok := s.parsedPPS[id]
+	return pps, ok
+}
+
+// ParseSlice decodes the header of a coded slice with the SPS/PPS it
+// references. When those are unknown the header is returned incomplete.
+func (s *ParameterSetStore) ParseSlice(slice []byte) (*healerTypes.SliceHeader, error) {
+	ppsID, err := helper.SlicePPSID(slice)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	pps := s.parsedPPS[ppsID]
+	var sps *healerTypes.SPS
+	if pps != nil {
+		sps = s.parsedSPS[pps.SPSID]
+	}
+	s.mu.RUnlock()
+
+	return helper.ParseSliceHeader(slice, sps, pps)
+}
+
+// Latest returns the most recently learned SPS and PPS.
+func (s *ParameterSetStore) Latest() (sps []byte, pps []byte) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.latestSPS, s.latestPPS
+}
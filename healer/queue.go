@@ -0,0 +1,242 @@
+package healer
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// DefaultQueueSize is the number of access units a subscription queues before
+// it starts dropping, about two seconds of 30 fps video.
+const DefaultQueueSize = 64
+
+// QueuePolicy selects what a subscription queue does when its sink falls behind.
+type QueuePolicy uint8
+
+const (
+	// DropOldest drops the oldest queued access unit. It is the default.
+	DropOldest QueuePolicy = iota
+	// Block makes Push wait until the sink catches up. Use it only when the
+	// source can be paused, such as a file; a live RTSP session would stall.
+	Block
+	// DropNonReference drops the oldest non-reference access unit first
+	// (nal_ref_idc 0, which no other picture depends on). When there is none
+	// it drops the oldest reference picture with the rest of its GOP, up to
+	// the next IDR. IDRs and parameter sets are never dropped, so the queue
+	// may briefly exceed its size.
+	DropNonReference
+)
+
+// QueueStats counts the access units a subscription queue dropped or waited for.
+type QueueStats struct {
+	// DroppedUnits counts every access unit dropped because the queue was full.
+	DroppedUnits uint64
+	// DroppedNonReference and DroppedReference split DroppedUnits by the
+	// nal_ref_idc of their slices.
+	DroppedNonReference uint64
+	DroppedReference    uint64
+	// Blocked counts the times Push waited for the sink (Block).
+	Blocked uint64
+}
+
+// outputUnit is an access unit as handed to the subscriptions: its output
+// header, and the parameter sets of the STAP-A that precedes it, if any.
+// replayed marks the units of a GOP cache replay.
+type outputUnit struct {
+	au       *AccessUnit
+	header   rtp.Header
+	sps      []byte
+	pps      []byte
+	replayed bool
+}
+
+// protected reports whether the unit must never be dropped: an IDR, or a unit
+// carrying parameter sets the following pictures need.
+func (u outputUnit) protected() bool {
+	return u.au.IsKeyframe || len(u.sps) > 0 || u.au.hasParameterSets()
+}
+
+// unitQueue is the bounded queue between the healer and one subscription.
+type unitQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	units  []outputUnit
+	max    int
+	policy QueuePolicy
+	closed bool
+	stats  QueueStats
+
+	// waitIDR is set once a reference picture was dropped: the pictures
+	// after it cannot be decoded until the next IDR (DropNonReference).
+	waitIDR bool
+	// replay is a replay of the GOP cache that took the place of the queued
+	// units. It is served first and does not count against the limit.
+	// replayed is its last access unit: the healer may still be delivering
+	// it, and it is skipped with the units before it.
+	replay   []outputUnit
+	replayed *AccessUnit
+}
+
+func newUnitQueue(max int, policy QueuePolicy) *unitQueue {
+	if max <= 0 {
+		max = DefaultQueueSize
+	}
+	q := &unitQueue{max: max, policy: policy}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push appends units, applying the policy past the limit.
+func (q *unitQueue) push(units []outputUnit) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.cond.Broadcast()
+
+	if q.replayed != nil {
+		for i, unit := range units {
+			if unit.au == q.replayed {
+				units = units[i+1:]
+				break
+			}
+		}
+		q.replayed = nil
+	}
+
+	for _, unit := range units {
+		if q.policy == Block && len(q.units) >= q.max && !q.closed {
+			q.stats.Blocked++
+			// the consumer may be parked in pop since before this call
+			q.cond.Broadcast()
+			for len(q.units) >= q.max && !q.closed {
+				q.cond.Wait()
+			}
+		}
+		if q.closed {
+			return
+		}
+
+		if q.waitIDR {
+			if !unit.protected() {
+				q.drop(unit)
+				continue
+			}
+			q.waitIDR = !unit.au.IsKeyframe
+		}
+		q.units = append(q.units, unit)
+		if len(q.units) > q.max {
+			q.shed()
+		}
+		q.cond.Broadcast()
+	}
+}
+
+// shed drops queued access units according to the policy.
+func (q *unitQueue) shed() {
+	if q.policy != DropNonReference {
+		q.drop(q.units[0])
+		q.remove(0)
+		return
+	}
+
+	for i, unit := range q.units {
+		if !unit.protected() && !unit.au.IsReference() {
+			q.drop(unit)
+			q.remove(i)
+			return
+		}
+	}
+
+	for i, unit := range q.units {
+		if unit.protected() {
+			continue
+		}
+		// the pictures after it reference it, directly or not, up to the next IDR
+		kept := q.units[:i]
+		q.waitIDR = true
+		for j, next := range q.units[i:] {
+			if next.au.IsKeyframe {
+				kept = append(kept, q.units[i+j:]...)
+				q.waitIDR = false
+				break
+			}
+			if next.protected() {
+				kept = append(kept, next)
+				continue
+			}
+			q.drop(next)
+		}
+		clear(q.units[len(kept):])
+		q.units = kept
+		return
+	}
+}
+
+func (q *unitQueue) drop(unit outputUnit) {
+	q.stats.DroppedUnits++
+	if unit.au.IsReference() {
+		q.stats.DroppedReference++
+	} else {
+		q.stats.DroppedNonReference++
+	}
+}
+
+func (q *unitQueue) remove(i int) {
+	copy(q.units[i:], q.units[i+1:])
+	q.units[len(q.units)-1] = outputUnit{}
+	q.units = q.units[:len(q.units)-1]
+}
+
+// reset replaces the queued access units with a replay of the GOP cache,
+// which already holds them.
+func (q *unitQueue) reset(units []outputUnit) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	clear(q.units)
+	q.units = q.units[:0]
+	q.replay = units
+	q.replayed = units[len(units)-1].au
+	q.waitIDR = false
+	q.cond.Broadcast()
+}
+
+// pop waits for the next access unit. It returns false once the queue is closed.
+func (q *unitQueue) pop() (outputUnit, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.replay) == 0 && len(q.units) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return outputUnit{}, false
+	}
+	if len(q.replay) > 0 {
+		unit := q.replay[0]
+		q.replay = q.replay[1:]
+		return unit, true
+	}
+	unit := q.units[0]
+	q.remove(0)
+	// wake a producer waiting for room (Block)
+	q.cond.Broadcast()
+	return unit, true
+}
+
+// close wakes the consumer and the blocked producers and discards the queued
+// access units.
+func (q *unitQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.units = nil
+	q.replay = nil
+	q.cond.Broadcast()
+}
+
+func (q *unitQueue) queueStats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
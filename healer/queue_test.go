@@ -0,0 +1,123 @@
+package healer
+
+import (
+	"testing"
+	"time"
+)
+
+// queueUnit is an access unit made of one NAL unit with the given header:
+// 0x65 an IDR, 0x41 a reference P picture, 0x01 a non-reference picture.
+func queueUnit(header byte) outputUnit {
+	return outputUnit{au: &AccessUnit{NALUs: [][]byte{{header}}, IsKeyframe: header&0x1F == 5}}
+}
+
+// popAll pops the queued units without waiting for more.
+func popAll(q *unitQueue) []*AccessUnit {
+	var aus []*AccessUnit
+	for {
+		q.mu.Lock()
+		empty := len(q.replay) == 0 && len(q.units) == 0
+		q.mu.Unlock()
+		if empty {
+			return aus
+		}
+		unit, _ := q.pop()
+		aus = append(aus, unit.au)
+	}
+}
+
+func checkUnits(t *testing.T, got []*AccessUnit, want []outputUnit) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d units, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i].au {
+			t.Errorf("unit %d: got %x, want %x", i, got[i].NALUs, want[i].au.NALUs)
+		}
+	}
+}
+
+func TestUnitQueueDropOldest(t *testing.T) {
+	q := newUnitQueue(2, DropOldest)
+	units := []outputUnit{queueUnit(0x65), queueUnit(0x41), queueUnit(0x01)}
+	q.push(units)
+
+	checkUnits(t, popAll(q), units[1:])
+	if stats := q.queueStats(); stats.DroppedUnits != 1 || stats.DroppedReference != 1 {
+		t.Errorf("stats %+v, want one reference unit dropped", stats)
+	}
+}
+
+func TestUnitQueueBlock(t *testing.T) {
+	q := newUnitQueue(1, Block)
+	units := []outputUnit{queueUnit(0x65), queueUnit(0x41), queueUnit(0x41)}
+
+	// the consumer is parked on the empty queue before the units arrive
+	popped := make(chan *AccessUnit, len(units))
+	go func() {
+		for {
+			unit, ok := q.pop()
+			if !ok {
+				return
+			}
+			popped <- unit.au
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push(units)
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(2 * time.Second):
+		q.close()
+		t.Fatal("push blocked with the consumer waiting")
+	}
+
+	var got []*AccessUnit
+	for range units {
+		select {
+		case au := <-popped:
+			got = append(got, au)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d units, want %d", len(got), len(units))
+		}
+	}
+	q.close()
+
+	checkUnits(t, got, units)
+	if stats := q.queueStats(); stats.DroppedUnits != 0 || stats.Blocked == 0 {
+		t.Errorf("stats %+v, want blocked pushes and no drop", stats)
+	}
+}
+
+func TestUnitQueueDropNonReference(t *testing.T) {
+	t.Run("non-reference first", func(t *testing.T) {
+		q := newUnitQueue(3, DropNonReference)
+		units := []outputUnit{queueUnit(0x65), queueUnit(0x41), queueUnit(0x01), queueUnit(0x41)}
+		q.push(units)
+
+		checkUnits(t, popAll(q), []outputUnit{units[0], units[1], units[3]})
+		if stats := q.queueStats(); stats.DroppedUnits != 1 || stats.DroppedNonReference != 1 {
+			t.Errorf("stats %+v, want one non-reference unit dropped", stats)
+		}
+	})
+
+	t.Run("reference up to the next IDR", func(t *testing.T) {
+		q := newUnitQueue(3, DropNonReference)
+		units := []outputUnit{queueUnit(0x65), queueUnit(0x41), queueUnit(0x41), queueUnit(0x41)}
+		q.push(units)
+		// the P picture cannot be decoded until the IDR that follows it
+		next := []outputUnit{queueUnit(0x41), queueUnit(0x65), queueUnit(0x41)}
+		q.push(next)
+
+		checkUnits(t, popAll(q), []outputUnit{units[0], next[1], next[2]})
+		if stats := q.queueStats(); stats.DroppedUnits != 4 || stats.DroppedReference != 4 {
+			t.Errorf("stats %+v, want four reference units dropped", stats)
+		}
+	})
+}
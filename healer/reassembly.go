@@ -0,0 +1,285 @@
+package healer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
+	"github.com/LacavaDev/mitra-rtp-healer/helper"
+	"github.com/pion/rtp"
+)
+
+// DefaultReassemblyTimeout bounds how long the fragments of one FU-A are kept
+// waiting for the end fragment when WithReassemblyTimeout is not set.
+const DefaultReassemblyTimeout = 500 * time.Millisecond
+
+// IncompletePolicy selects what happens to a FU-A NAL unit whose fragments did
+// not all arrive.
+type IncompletePolicy uint8
+
+const (
+	// DiscardIncomplete drops the whole NAL unit.
+	DiscardIncomplete IncompletePolicy = iota
+	// TruncateIncomplete forwards the fragments received before the first
+	// missing one and flags the access unit as Incomplete.
+	TruncateIncomplete
+	// SalvageIncomplete forwards the same prefix as TruncateIncomplete with
+	// the F bit set, as RFC 6184 5.8 requires for an incomplete NAL unit, so
+	// decoders conceal the damaged part instead of failing on it.
+	SalvageIncomplete
+)
+
+// ReassemblyStats counts the outcome of FU-A reassembly since the healer was created.
+type ReassemblyStats struct {
+	// Completed counts NAL units rebuilt from all of their fragments.
+	Completed uint64
+	// Discarded, Truncated and Salvaged count incomplete or damaged NAL
+	// units, per IncompletePolicy. Salvaged NAL units have the F bit set.
+	Discarded uint64
+	Truncated uint64
+	Salvaged  uint64
+	// MissingStart counts fragments dropped because the start fragment of
+	// their NAL unit was never seen.
+	MissingStart uint64
+	// MissingEnd counts NAL units interrupted by a new start fragment, a
+	// timestamp change or another NAL unit before their end fragment.
+	MissingEnd uint64
+	// Gaps counts sequence number jumps inside a NAL unit.
+	Gaps uint64
+	// Timeouts counts NAL units still waiting for fragments after the timeout.
+	Timeouts uint64
+}
+
+// reassembledNALU is a NAL unit rebuilt from FU-A fragments.
+type reassembledNALU struct {
+	pkt       *rtp.Packet
+	truncated bool
+	// source lists the fragments it was rebuilt from.
+	source nalSource
+}
+
+// lostNALU identifies a NAL unit the reassembler dropped, so its access unit
+// can be flagged as Incomplete.
+type lostNALU struct {
+	timestamp uint32
+	ssrc      uint32
+}
+
+// fuaReassembler rebuilds the NAL unit carried by consecutive FU-A fragments.
+// A NAL unit is keyed by its timestamp and SSRC and must arrive with
+// contiguous sequence numbers; anything else makes it incomplete.
+type fuaReassembler struct {
+	policy      IncompletePolicy
+	timeout     time.Duration
+	maxNaluSize int
+	stats       ReassemblyStats
+	// oversized counts NAL units dropped for exceeding maxNaluSize.
+	oversized uint64
+
+	fragments []*healerTypes.NaluInfo
+	size      int
+	started   time.Time
+	nextSeq   uint16
+	// skipping drops the remaining fragments of a NAL unit already reported
+	// incomplete, until the next start fragment.
+	skipping      bool
+	skipSSRC      uint32
+	skipTimestamp uint32
+	// lost lists the NAL units dropped since the last takeLost.
+	lost []lostNALU
+}
+
+func newFUAReassembler() *fuaReassembler {
+	return &fuaReassembler{
+		policy:      DiscardIncomplete,
+		timeout:     DefaultReassemblyTimeout,
+		maxNaluSize: helper.DefaultMaxNaluSize,
+	}
+}
+
+// push adds one FU-A fragment. It returns the NAL unit the fragment completed,
+// or the prefix of the NAL unit it interrupted under TruncateIncomplete.
+func (r *fuaReassembler) push(info healerTypes.NaluInfo, now time.Time) (*reassembledNALU, error) {
+	pkt := info.Pkt
+
+	if info.StartBit {
+		var (
+			nalu *reassembledNALU
+			err  error
+		)
+		if len(r.fragments) > 0 {
+			r.stats.MissingEnd++
+			nalu = r.abort()
+			err = &helper.FUASequenceError{Err: helper.ErrMissingEndFragment, Index: -1, Got: 0, Expected: 1}
+		}
+		r.skipping = false
+		r.fragments = append(r.fragments[:0], &info)
+		r.size = len(pkt.Payload) - 1
+		r.started = now
+		r.nextSeq = pkt.SequenceNumber + 1
+		if r.size > r.maxNaluSize {
+			r.oversized++
+			overflow := &helper.OverflowError{Limit: "NALU size", Size: r.size, Max: r.maxNaluSize}
+			r.discard()
+			return nalu, errors.Join(err, overflow)
+		}
+		return nalu, err
+	}
+
+	if len(r.fragments) == 0 {
+		if r.skipping && pkt.SSRC == r.skipSSRC && pkt.Timestamp == r.skipTimestamp {
+			return nil, nil
+		}
+		r.stats.MissingStart++
+		r.lose(pkt)
+		r.skip(pkt)
+		return nil, &helper.FUASequenceError{Err: helper.ErrMissingStartFragment, Index: -1, Got: 0, Expected: 1}
+	}
+
+	first := r.fragments[0].Pkt
+	if pkt.SSRC != first.SSRC || pkt.Timestamp != first.Timestamp {
+		// the end of the previous NAL unit and the start of this one are lost
+		r.stats.MissingEnd++
+		r.stats.MissingStart++
+		nalu := r.abort()
+		r.lose(pkt)
+		r.skip(pkt)
+		return nalu, &helper.FUASequenceError{Err: helper.ErrMissingEndFragment, Index: -1, Got: 0, Expected: 1}
+	}
+
+	if pkt.SequenceNumber != r.nextSeq {
+		r.stats.Gaps++
+		err := &helper.FUASequenceError{
+			Err:      helper.ErrMissingFragment,
+			Index:    len(r.fragments),
+			Got:      uint32(pkt.SequenceNumber),
+			Expected: uint32(r.nextSeq),
+		}
+		nalu := r.abort()
+		r.skip(pkt)
+		return nalu, err
+	}
+
+	if size := r.size + len(pkt.Payload) - 2; size > r.maxNaluSize {
+		r.oversized++
+		r.discard()
+		return nil, &helper.OverflowError{Limit: "NALU size", Size: size, Max: r.maxNaluSize}
+	}
+
+	r.fragments = append(r.fragments, &info)
+	r.size += len(pkt.Payload) - 2
+	r.nextSeq++
+	if !info.EndBit {
+		return nil, nil
+	}
+
+	validationErr := helper.ValidateFUASequence(r.fragments)
+	// a complete NAL unit flagged as damaged by a middlebox is rebuilt with
+	// F=1, unless damaged NAL units are discarded
+	damaged := errors.Is(validationErr, helper.ErrForbiddenBitMismatch)
+	if validationErr != nil && (!damaged || r.policy == DiscardIncomplete) {
+		r.lose(first)
+		r.reset()
+		r.stats.Discarded++
+		return nil, validationErr
+	}
+	built, err := helper.BuildSingleNaluFromFUAPackets(r.fragments)
+	source := fragmentSource(r.fragments)
+	r.reset()
+	if err != nil {
+		r.stats.Discarded++
+		r.lose(first)
+		return nil, err
+	}
+	if damaged {
+		r.stats.Salvaged++
+		return &reassembledNALU{pkt: built, truncated: true, source: source}, validationErr
+	}
+	r.stats.Completed++
+	return &reassembledNALU{pkt: built, source: source}, nil
+}
+
+// interrupt ends the NAL unit being reassembled because a NAL unit of another
+// kind arrived, or the stream is being flushed.
+func (r *fuaReassembler) interrupt() (*reassembledNALU, error) {
+	r.skipping = false
+	if len(r.fragments) == 0 {
+		return nil, nil
+	}
+	r.stats.MissingEnd++
+	return r.abort(), &helper.FUASequenceError{Err: helper.ErrMissingEndFragment, Index: -1, Got: 0, Expected: 1}
+}
+
+// expire gives up on a NAL unit that has been waiting longer than the timeout.
+func (r *fuaReassembler) expire(now time.Time) (*reassembledNALU, error) {
+	if len(r.fragments) == 0 || r.timeout <= 0 || now.Sub(r.started) < r.timeout {
+		return nil, nil
+	}
+	r.stats.Timeouts++
+	count := len(r.fragments)
+	first := r.fragments[0].Pkt
+	r.skip(first)
+	return r.abort(), fmt.Errorf("%w: %d fragments after %v", helper.ErrReassemblyTimeout, count, r.timeout)
+}
+
+// abort applies the IncompletePolicy to the fragments collected so far. The
+// marker bit is dropped: the rebuilt NAL unit may not end its access unit.
+func (r *fuaReassembler) abort() *reassembledNALU {
+	defer r.reset()
+
+	if r.policy == DiscardIncomplete {
+		r.stats.Discarded++
+		r.lose(r.fragments[0].Pkt)
+		return nil
+	}
+	built, err := helper.BuildSingleNaluFromFUAPackets(r.fragments)
+	if err != nil || len(built.Payload) < 2 {
+		r.stats.Discarded++
+		r.lose(r.fragments[0].Pkt)
+		return nil
+	}
+	built.Marker = false
+	if r.policy == SalvageIncomplete || built.Payload[0]&0x80 != 0 {
+		built.Payload[0] |= 0x80
+		r.stats.Salvaged++
+	} else {
+		r.stats.Truncated++
+	}
+	return &reassembledNALU{pkt: built, truncated: true, source: fragmentSource(r.fragments)}
+}
+
+// discard drops the NAL unit being reassembled, whatever the policy, along
+// with its remaining fragments.
+func (r *fuaReassembler) discard() {
+	if len(r.fragments) > 0 {
+		r.lose(r.fragments[0].Pkt)
+		r.skip(r.fragments[0].Pkt)
+	}
+	r.reset()
+}
+
+// lose records that the NAL unit pkt belongs to was dropped.
+func (r *fuaReassembler) lose(pkt *rtp.Packet) {
+	r.lost = append(r.lost, lostNALU{timestamp: pkt.Timestamp, ssrc: pkt.SSRC})
+}
+
+// takeLost returns the NAL units dropped since the last call.
+func (r *fuaReassembler) takeLost() []lostNALU {
+	lost := r.lost
+	r.lost = nil
+	return lost
+}
+
+// skip drops the following fragments of the NAL unit pkt belongs to.
+func (r *fuaReassembler) skip(pkt *rtp.Packet) {
+	r.skipping = true
+	r.skipSSRC = pkt.SSRC
+	r.skipTimestamp = pkt.Timestamp
+}
+
+func (r *fuaReassembler) reset() {
+	clear(r.fragments)
+	r.fragments = r.fragments[:0]
+	r.size = 0
+}
@@ -0,0 +1,271 @@
+package healer
+
+import (
+	"slices"
+	"sync"
+
+	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// DefaultSequenceMapSize is the number of output packets a SequenceMap
+// remembers when given zero, about one second of a 10 Mbit/s stream.
+const DefaultSequenceMapSize = 1024
+
+// nalSource records the source packets a NAL unit was rebuilt from. ends[i]
+// is the offset in the NAL unit where the bytes of seqs[i] end, so an output
+// fragment can be traced back to the source fragments it overlaps.
+type nalSource struct {
+	seqs []uint16
+	ends []int
+}
+
+// singleSource is the source of a NAL unit carried whole by one packet.
+func singleSource(seq uint16, size int) nalSource {
+	return nalSource{seqs: []uint16{seq}, ends: []int{size}}
+}
+
+// fragmentSource is the source of a NAL unit rebuilt from FU-A fragments: the
+// NAL unit header, then the payload of each fragment after its FU header.
+func fragmentSource(fragments []*healerTypes.NaluInfo) nalSource {
+	src := nalSource{seqs: make([]uint16, len(fragments)), ends: make([]int, len(fragments))}
+	end := 1
+	for i, fragment := range fragments {
+		end += max(len(fragment.Pkt.Payload)-2, 0)
+		src.seqs[i] = fragment.Pkt.SequenceNumber
+		src.ends[i] = end
+	}
+	return src
+}
+
+// between returns the source packets carrying bytes start to end of the NAL unit.
+func (s nalSource) between(start int, end int) []uint16 {
+	var seqs []uint16
+	for i, seq := range s.seqs {
+		first := 0
+		if i > 0 {
+			first = s.ends[i-1]
+		}
+		if first < end && s.ends[i] > start {
+			seqs = append(seqs, seq)
+		}
+	}
+	return seqs
+}
+
+// packetSources returns, for each packet carrying au, the source packets it
+// carries data from. Injected STAP-A packets have none: the healer splits the
+// STAP-A packets of the source, so every STAP-A in pkts was injected.
+func packetSources(au *AccessUnit, pkts []*rtp.Packet) [][]uint16 {
+	var injected [][]byte
+	for _, pkt := range pkts {
+		if len(pkt.Payload) > 0 && pkt.Payload[0]&0x1F == 24 {
+			injected = injectedSets(pkt)
+			break
+		}
+	}
+
+	sources := make([][]uint16, len(pkts))
+	nalu := -1
+	offset := 0
+	next := func() nalSource {
+		// the parameter sets of the STAP-A are left out, see packetizeAccessUnit
+		for nalu++; nalu < len(au.NALUs); nalu++ {
+			if !carries(injected, au.NALUs[nalu]) {
+				break
+			}
+		}
+		if nalu < len(au.sources) {
+			return au.sources[nalu]
+		}
+		return nalSource{}
+	}
+
+	var src nalSource
+	for i, pkt := range pkts {
+		if len(pkt.Payload) == 0 {
+			continue
+		}
+		switch nalType := pkt.Payload[0] & 0x1F; {
+		case nalType == 24:
+		case nalType == 28 && len(pkt.Payload) >= 2:
+			size := len(pkt.Payload) - 2
+			if pkt.Payload[1]&0x80 != 0 {
+				src = next()
+				// the start fragment also carries the NAL unit header
+				offset = 0
+				size++
+			}
+			sources[i] = src.between(offset, offset+size)
+			offset += size
+		default:
+			src = next()
+			sources[i] = src.between(0, len(pkt.Payload))
+		}
+	}
+	return sources
+}
+
+// SequenceMap links the packets of an output stream to the source packets
+// they carry, in both directions, and keeps the last packets sent so a NACK
+// from a viewer can be answered locally or translated toward the source. The
+// healer renumbers its output, so the sequence numbers of a viewer NACK mean
+// nothing upstream. It is safe for concurrent use.
+type SequenceMap struct {
+	mu      sync.Mutex
+	entries []seqEntry
+	outputs map[uint16][]uint16
+}
+
+type seqEntry struct {
+	used    bool
+	pkt     *rtp.Packet
+	ssrc    uint32
+	sources []uint16
+}
+
+// NewSequenceMap creates a map remembering the last size output packets.
+func NewSequenceMap(size int) *SequenceMap {
+	if size <= 0 {
+		size = DefaultSequenceMapSize
+	}
+	return &SequenceMap{
+		entries: make([]seqEntry, size),
+		outputs: make(map[uint16][]uint16),
+	}
+}
+
+// recordUnit remembers the stamped packets carrying au.
+func (m *SequenceMap) recordUnit(au *AccessUnit, pkts []*rtp.Packet) {
+	sources := packetSources(au, pkts)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, pkt := range pkts {
+		m.add(pkt, au.SSRC, sources[i])
+	}
+}
+
+// record remembers one stamped packet carrying data of the given sources.
+func (m *SequenceMap) record(pkt *rtp.Packet, ssrc uint32, sources []uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(pkt, ssrc, sources)
+}
+
+func (m *SequenceMap) add(pkt *rtp.Packet, ssrc uint32, sources []uint16) {
+	seq := pkt.SequenceNumber
+	entry := &m.entries[int(seq)%len(m.entries)]
+	if entry.used {
+		m.forget(entry)
+	}
+	*entry = seqEntry{used: true, pkt: pkt.Clone(), ssrc: ssrc, sources: sources}
+	for _, source := range sources {
+		m.outputs[source] = append(m.outputs[source], seq)
+	}
+}
+
+// forget removes the output packet of entry from the source index.
+func (m *SequenceMap) forget(entry *seqEntry) {
+	seq := entry.pkt.SequenceNumber
+	for _, source := range entry.sources {
+		outputs := slices.DeleteFunc(m.outputs[source], func(out uint16) bool { return out == seq })
+		if len(outputs) == 0 {
+			delete(m.outputs, source)
+		} else {
+			m.outputs[source] = outputs
+		}
+	}
+}
+
+func (m *SequenceMap) lookup(seq uint16) *seqEntry {
+	entry := &m.entries[int(seq)%len(m.entries)]
+	if !entry.used || entry.pkt.SequenceNumber != seq {
+		return nil
+	}
+	return entry
+}
+
+// Sources returns the source sequence numbers carried by an output packet.
+// ok is false when the packet is unknown or was forgotten; an injected
+// STAP-A is known but has no source.
+func (m *SequenceMap) Sources(seq uint16) (sources []uint16, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.lookup(seq)
+	if entry == nil {
+		return nil, false
+	}
+	return slices.Clone(entry.sources), true
+}
+
+// Outputs returns the output sequence numbers carrying data of a source packet.
+func (m *SequenceMap) Outputs(source uint16) []uint16 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.outputs[source])
+}
+
+// Packet returns a copy of an output packet still remembered.
+func (m *SequenceMap) Packet(seq uint16) (*rtp.Packet, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.lookup(seq)
+	if entry == nil {
+		return nil, false
+	}
+	return entry.pkt.Clone(), true
+}
+
+// Retransmit answers nack from the remembered packets. It returns copies of
+// the packets to send again, in the order requested, and the sequence numbers
+// that were forgotten; translate those with TranslateNACK.
+func (m *SequenceMap) Retransmit(nack *rtcp.TransportLayerNack) (pkts []*rtp.Packet, missing []uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, pair := range nack.Nacks {
+		for _, seq := range pair.PacketList() {
+			if entry := m.lookup(seq); entry != nil {
+				pkts = append(pkts, entry.pkt.Clone())
+			} else {
+				missing = append(missing, seq)
+			}
+		}
+	}
+	return pkts, missing
+}
+
+// TranslateNACK turns a NACK of output packets into a NACK of the source
+// packets they carry, addressed to the source SSRC, to be sent upstream. It
+// returns nil when none of the packets is known or carries source data.
+func (m *SequenceMap) TranslateNACK(nack *rtcp.TransportLayerNack) *rtcp.TransportLayerNack {
+	m.mu.Lock()
+	var (
+		sources []uint16
+		ssrc    uint32
+	)
+	for _, pair := range nack.Nacks {
+		for _, seq := range pair.PacketList() {
+			if entry := m.lookup(seq); entry != nil && len(entry.sources) > 0 {
+				sources = append(sources, entry.sources...)
+				ssrc = entry.ssrc
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	if len(sources) == 0 {
+		return nil
+	}
+	// NACK pairs need increasing sequence numbers, across a wrap-around too
+	first := sources[0]
+	slices.SortFunc(sources, func(a, b uint16) int {
+		return int(int16(a-first)) - int(int16(b-first))
+	})
+	return &rtcp.TransportLayerNack{
+		SenderSSRC: nack.SenderSSRC,
+		MediaSSRC:  ssrc,
+		Nacks:      rtcp.NackPairsFromSequenceNumbers(slices.Compact(sources)),
+	}
+}
@@ -0,0 +1,134 @@
+package healer
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// nackedSequences lists the sequence numbers of nack in order.
+func nackedSequences(nack *rtcp.TransportLayerNack) []uint16 {
+	var seqs []uint16
+	for _, pair := range nack.Nacks {
+		seqs = append(seqs, pair.PacketList()...)
+	}
+	return seqs
+}
+
+func TestSequenceMapAcrossRefragmentation(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		first  uint16
+		inject bool
+	}{
+		{name: "injected STAP-A", first: 100, inject: true},
+		{name: "no injection", first: 100},
+		{name: "injected STAP-A across a wrap", first: 65533, inject: true},
+		{name: "no injection across a wrap", first: 65533},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// the IDR comes as two FU-A fragments split at byte 75 and leaves
+			// as three split at bytes 51 and 101: the middle one carries both
+			opts := []Option{WithMTU(64), WithSequenceMap(0)}
+			if !tc.inject {
+				opts = append(opts, WithInjectionPolicy(InjectionPolicy{}))
+			}
+			h := NewH264Healer(opts...)
+
+			sps, pps, idr := tc.first, tc.first+1, tc.first+2
+			payloads := append([][]byte{testSPS, testPPS}, fragmented(padded(testIDR, 150))...)
+			var out []*rtp.Packet
+			for i, payload := range payloads {
+				pkt := &rtp.Packet{
+					Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: tc.first + uint16(i), Timestamp: 3000, SSRC: 1, Marker: i == len(payloads)-1},
+					Payload: payload,
+				}
+				pkts, err := h.Push(pkt)
+				if err != nil {
+					t.Fatalf("push %d: %v", pkt.SequenceNumber, err)
+				}
+				out = append(out, pkts...)
+			}
+
+			want := [][]uint16{{sps}, {pps}}
+			if tc.inject {
+				want = [][]uint16{{}}
+			}
+			want = append(want, []uint16{idr}, []uint16{idr, idr + 1}, []uint16{idr + 1})
+			if len(out) != len(want) {
+				t.Fatalf("got %d packets, want %d", len(out), len(want))
+			}
+
+			m := h.SequenceMap()
+			var outputs []uint16
+			for i, pkt := range out {
+				outputs = append(outputs, pkt.SequenceNumber)
+				sources, ok := m.Sources(pkt.SequenceNumber)
+				if !ok || !slices.Equal(sources, want[i]) {
+					t.Errorf("packet %d carries %v (%v), want %v", i, sources, ok, want[i])
+				}
+			}
+			if got := m.Outputs(idr + 1); !slices.Equal(got, outputs[len(outputs)-2:]) {
+				t.Errorf("Outputs(%d) = %v, want %v", idr+1, got, outputs[len(outputs)-2:])
+			}
+
+			nack := &rtcp.TransportLayerNack{SenderSSRC: 7, Nacks: rtcp.NackPairsFromSequenceNumbers(outputs)}
+			translated := m.TranslateNACK(nack)
+			if translated == nil {
+				t.Fatal("TranslateNACK returned nil")
+			}
+			wantSources := []uint16{idr, idr + 1}
+			if !tc.inject {
+				wantSources = []uint16{sps, pps, idr, idr + 1}
+			}
+			if got := nackedSequences(translated); !slices.Equal(got, wantSources) {
+				t.Errorf("translated NACK lists %v, want %v", got, wantSources)
+			}
+			if translated.MediaSSRC != 1 || translated.SenderSSRC != 7 {
+				t.Errorf("translated NACK from %d for %d, want from 7 for 1", translated.SenderSSRC, translated.MediaSSRC)
+			}
+			if tc.inject {
+				stapA := &rtcp.TransportLayerNack{Nacks: rtcp.NackPairsFromSequenceNumbers(outputs[:1])}
+				if got := m.TranslateNACK(stapA); got != nil {
+					t.Errorf("NACK of the injected STAP-A translated to %v, want nil", nackedSequences(got))
+				}
+			}
+		})
+	}
+}
+
+func TestSequenceMapRetransmit(t *testing.T) {
+	m := NewSequenceMap(4)
+	for seq := uint16(65534); seq != 4; seq++ {
+		pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, SSRC: 9}, Payload: []byte{0x41, byte(seq)}}
+		m.record(pkt, 1, []uint16{seq + 1000})
+	}
+
+	// 65534 and 65535 were forgotten to make room for 0 to 3
+	nack := &rtcp.TransportLayerNack{Nacks: rtcp.NackPairsFromSequenceNumbers([]uint16{65535, 0, 3})}
+	pkts, missing := m.Retransmit(nack)
+	if got := sequences(pkts); !slices.Equal(got, []uint16{0, 3}) {
+		t.Fatalf("retransmitted %v, want [0 3]", got)
+	}
+	if !slices.Equal(missing, []uint16{65535}) {
+		t.Errorf("missing %v, want [65535]", missing)
+	}
+	if pkts[0].Payload[1] != 0 {
+		t.Errorf("retransmitted payload %x, want the recorded one", pkts[0].Payload)
+	}
+
+	// the copies are the caller's
+	pkts[0].Payload[1] = 0xff
+	if pkt, ok := m.Packet(0); !ok || pkt.Payload[1] != 0 {
+		t.Errorf("remembered packet changed to %v (%v)", pkt, ok)
+	}
+	if _, ok := m.Sources(65534); ok {
+		t.Error("Sources of a forgotten packet reported as known")
+	}
+	// 998 is the source of 65534, 1000 later
+	if got := m.Outputs(998); len(got) != 0 {
+		t.Errorf("Outputs of a forgotten source = %v, want none", got)
+	}
+}
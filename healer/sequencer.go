@@ -0,0 +1,48 @@
+package healer
+
+import (
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+)
+
+// Sequencer is the single owner of output sequence numbers. Every packet that
+// leaves the healer, STAP-A injections included, is numbered here, so the RTSP
+// callback and the writer goroutine never share a counter.
+//
+// The 16-bit RTP sequence number is the low half of a 32-bit extended counter
+// (RFC 3550 appendix A.1), which keeps counting across wrap-arounds.
+type Sequencer struct {
+	extended atomic.Uint32
+}
+
+// NewSequencer creates a sequencer whose first assigned number is initial.
+func NewSequencer(initial uint16) *Sequencer {
+	s := &Sequencer{}
+	s.extended.Store(uint32(initial))
+	return s
+}
+
+// Next reserves the next sequence number and returns it together with its
+// extended value.
+func (s *Sequencer) Next() (uint16, uint32) {
+	ext := s.extended.Add(1) - 1
+	return uint16(ext), ext
+}
+
+// Stamp assigns the next sequence number to pkt and returns the extended value.
+func (s *Sequencer) Stamp(pkt *rtp.Packet) uint32 {
+	seq, ext := s.Next()
+	pkt.SequenceNumber = seq
+	return ext
+}
+
+// Peek returns the extended value the next call to Next will reserve.
+func (s *Sequencer) Peek() uint32 {
+	return s.extended.Load()
+}
+
+// Cycles returns how many times the 16-bit sequence number has wrapped.
+func (s *Sequencer) Cycles() uint16 {
+	return uint16(s.Peek() >> 16)
+}
@@ -0,0 +1,39 @@
+package healer
+
+// Stats is a snapshot of the counters of a healer.
+type Stats struct {
+	Reassembly ReassemblyStats
+	Overflows  OverflowStats
+	// Jitter is zero unless WithJitterBuffer is set.
+	Jitter JitterStats
+	Gating GatingStats
+	// Feedback counts the PLI and FIR passed to HandleRTCP.
+	Feedback FeedbackStats
+}
+
+// OverflowStats counts the data dropped because a buffer hit its limit.
+type OverflowStats struct {
+	// NaluSize counts FU-A NAL units dropped for exceeding WithMaxNaluSize.
+	NaluSize uint64
+	// BufferedPackets counts the times the healer held more than
+	// WithMaxBufferedPackets source packets and dropped buffered data.
+	BufferedPackets uint64
+}
+
+// Stats returns the counters accumulated since the healer was created.
+func (h *H264Healer) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	overflows := h.overflows
+	overflows.NaluSize = h.reassembler.oversized
+	stats := Stats{
+		Reassembly: h.reassembler.stats,
+		Overflows:  overflows,
+		Gating:     h.gate.stats,
+		Feedback:   h.feedback,
+	}
+	if h.jitter != nil {
+		stats.Jitter = h.jitter.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,302 @@
+package healer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LacavaDev/mitra-rtp-healer/helper"
+	"github.com/pion/rtp"
+)
+
+// replayTimestampStep spaces the replayed access units by 1 ms of the 90 kHz
+// clock, so a late joiner decodes the cached GOP almost at once instead of
+// playing it back at its original pace.
+const replayTimestampStep = 90
+
+// Sink receives the packets of a subscription. A pion TrackLocalStaticRTP and
+// a UDPTap are sinks.
+type Sink interface {
+	WriteRTP(pkt *rtp.Packet) error
+}
+
+// SinkFunc adapts a function to the Sink interface.
+type SinkFunc func(pkt *rtp.Packet) error
+
+// WriteRTP calls f(pkt).
+func (f SinkFunc) WriteRTP(pkt *rtp.Packet) error {
+	return f(pkt)
+}
+
+// SubscribeOption configures a Subscription.
+type SubscribeOption func(*Subscription)
+
+// WithSubscriberMTU packetizes the subscription with its own maximum RTP
+// packet size instead of the healer's.
+func WithSubscriberMTU(mtu int) SubscribeOption {
+	return func(s *Subscription) {
+		if mtu > 0 {
+			s.mtu = mtu
+		}
+	}
+}
+
+// WithQueueSize sets how many access units may wait for a slow sink. The
+// default is DefaultQueueSize.
+func WithQueueSize(units int) SubscribeOption {
+	return func(s *Subscription) {
+		s.queueSize = units
+	}
+}
+
+// WithQueuePolicy selects what happens when the queue is full. The default
+// is DropOldest.
+func WithQueuePolicy(policy QueuePolicy) SubscribeOption {
+	return func(s *Subscription) {
+		s.queuePolicy = policy
+	}
+}
+
+// WithSubscriberSequenceMap remembers the last size packets written to the
+// sink and the source packets they carry, to answer or translate the NACKs
+// of its viewer. Zero selects DefaultSequenceMapSize.
+func WithSubscriberSequenceMap(size int) SubscribeOption {
+	return func(s *Subscription) {
+		s.seqMap = NewSequenceMap(size)
+	}
+}
+
+// SubscriptionStats counts the work of one subscription.
+type SubscriptionStats struct {
+	// Packets counts the packets written to the sink.
+	Packets uint64
+	Queue   QueueStats
+}
+
+// Subscription is one consumer of the healed output. It has its own sequence
+// numbers, MTU and queue, and a goroutine writing to its sink, so a slow or
+// failing sink never holds back the healer or the other subscriptions, unless
+// its queue uses the Block policy.
+type Subscription struct {
+	healer    *H264Healer
+	sink      Sink
+	mtu       int
+	sequencer *Sequencer
+	seqMap    *SequenceMap
+	replay    []outputUnit
+
+	queueSize   int
+	queuePolicy QueuePolicy
+	queue       *unitQueue
+	// lastReplay is when the GOP cache was last replayed after a keyframe
+	// request; it is guarded by the healer lock.
+	lastReplay time.Time
+
+	// lastTimestamp is the timestamp of the last unit written and
+	// timestampOffset the shift applied to the live units so they follow a
+	// replay; both belong to the subscription goroutine, see timestamp.
+	lastTimestamp   uint32
+	hasTimestamp    bool
+	timestampOffset uint32
+	resync          bool
+
+	closed  atomic.Bool
+	packets atomic.Uint64
+	done    chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// Subscribe starts delivering the healed output to sink, from the next access
+// unit on, preceded by a STAP-A with the current SPS/PPS. When the healer has
+// a GOP cache the sink first receives a STAP-A with the cached SPS/PPS and the
+// cached access units instead, timestamps compressed so the last one keeps its
+// original value and live packets follow seamlessly. Subscriptions can be
+// added and closed at any time.
+//
+// The sink is called from the subscription goroutine, one packet at a time.
+// The first error it returns closes the subscription.
+func (h *H264Healer) Subscribe(sink Sink, opts ...SubscribeOption) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &Subscription{
+		healer:    h,
+		sink:      sink,
+		mtu:       h.mtu,
+		sequencer: NewSequencer(0),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(sub)
+	}
+	sub.queue = newUnitQueue(sub.queueSize, sub.queuePolicy)
+	sub.replay = h.replay()
+	h.subscribers = append(h.subscribers, sub)
+
+	go sub.run()
+	return sub
+}
+
+// Close stops the deliveries, discards the queued access units and releases
+// a Push blocked on the queue. It does not wait for a write in progress; use
+// Done for that. It is safe to call from the sink.
+func (s *Subscription) Close() {
+	if s.closed.Swap(true) {
+		return
+	}
+	s.healer.unsubscribe(s)
+	s.queue.close()
+}
+
+// Done is closed once the subscription goroutine has returned.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error that closed the subscription, if any.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// SequenceMap returns the sequence map of the subscription, nil unless
+// WithSubscriberSequenceMap was given.
+func (s *Subscription) SequenceMap() *SequenceMap {
+	return s.seqMap
+}
+
+// Stats returns the counters of the subscription.
+func (s *Subscription) Stats() SubscriptionStats {
+	return SubscriptionStats{
+		Packets: s.packets.Load(),
+		Queue:   s.queue.queueStats(),
+	}
+}
+
+func (s *Subscription) enqueue(units []outputUnit) {
+	s.queue.push(units)
+}
+
+func (s *Subscription) run() {
+	defer close(s.done)
+
+	replay := s.replay
+	s.replay = nil
+	for _, unit := range replay {
+		if !s.write(unit) {
+			return
+		}
+	}
+
+	// without a replay the sink joins mid-stream: the first picture it gets
+	// is preceded by the parameter sets, without injecting them for everyone
+	joined := len(replay) > 0
+	for {
+		unit, ok := s.queue.pop()
+		if !ok {
+			return
+		}
+		if !joined && unit.au.hasSlices() {
+			joined = true
+			if unit.sps == nil {
+				unit.sps, unit.pps = s.healer.ParameterSets()
+			}
+		}
+		if !s.write(unit) {
+			return
+		}
+	}
+}
+
+// timestamp returns the output timestamp of unit. A replay after a keyframe
+// request continues from the last timestamp the viewer received, so its clock
+// never goes back, and the live units that follow are shifted past the
+// replay when needed. The shift is kept for the rest of the subscription.
+func (s *Subscription) timestamp(unit outputUnit) uint32 {
+	ts := unit.header.Timestamp + s.timestampOffset
+	switch {
+	case unit.replayed && s.hasTimestamp:
+		ts = s.lastTimestamp + replayTimestampStep
+		s.resync = true
+	case s.resync && !unit.replayed:
+		s.resync = false
+		if int32(ts-s.lastTimestamp) <= 0 {
+			s.timestampOffset += s.lastTimestamp + replayTimestampStep - ts
+			ts = s.lastTimestamp + replayTimestampStep
+		}
+	}
+	s.lastTimestamp, s.hasTimestamp = ts, true
+	return ts
+}
+
+// write packetizes unit with the subscription MTU and writes it to the sink.
+func (s *Subscription) write(unit outputUnit) bool {
+	unit.header.Timestamp = s.timestamp(unit)
+	var stapA *rtp.Packet
+	if len(unit.sps) > 0 {
+		if pkt, err := helper.GenSTAPPacket(unit.sps, unit.pps, unit.header.Clone()); err == nil {
+			stapA = &pkt
+		}
+	}
+	// NAL units that cannot be packetized were already reported by Push
+	pkts, _ := packetizeAccessUnit(unit.au, unit.header, stapA, s.mtu)
+	var sources [][]uint16
+	if s.seqMap != nil {
+		sources = packetSources(unit.au, pkts)
+	}
+
+	for i, pkt := range pkts {
+		if s.closed.Load() {
+			return false
+		}
+		s.sequencer.Stamp(pkt)
+		if err := s.sink.WriteRTP(pkt); err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			s.Close()
+			return false
+		}
+		if s.seqMap != nil {
+			// after the write, so the copy kept is the packet as the sink sent it
+			s.seqMap.record(pkt, unit.au.SSRC, sources[i])
+		}
+		s.packets.Add(1)
+	}
+	return true
+}
+
+// replay turns the GOP cache into output units for a new subscription. The
+// caller holds h.mu.
+func (h *H264Healer) replay() []outputUnit {
+	if h.gopCache == nil {
+		return nil
+	}
+	units, sps, pps := h.gopCache.Snapshot()
+	if len(units) == 0 {
+		return nil
+	}
+
+	out := make([]outputUnit, len(units))
+	last := units[len(units)-1].Timestamp
+	for i, au := range units {
+		out[i] = outputUnit{au: au, header: h.outputHeader(au), replayed: true}
+		out[i].header.Timestamp = last - uint32(len(units)-1-i)*replayTimestampStep
+	}
+	out[0].sps, out[0].pps = sps, pps
+	return out
+}
+
+func (h *H264Healer) unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, s := range h.subscribers {
+		if s == sub {
+			h.subscribers = append(h.subscribers[:i:i], h.subscribers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package healer
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pion/rtp"
+)
+
+// Tap receives a mirror of every packet the healer outputs, STAP-A injections
+// included, in output order. It is meant for debugging (ffplay, Wireshark) and
+// is disabled unless configured with WithTap.
+//
+// WriteRTP is called while the healer holds its lock: it must not block for
+// long and must not retain or modify pkt. A pion TrackLocalStaticRTP satisfies
+// this interface too.
+type Tap interface {
+	WriteRTP(pkt *rtp.Packet) error
+}
+
+// UDPTap mirrors packets to a UDP address.
+type UDPTap struct {
+	conn *net.UDPConn
+}
+
+// NewUDPTap dials addr:port and returns a tap writing every packet to it.
+func NewUDPTap(addr string, port int) (*UDPTap, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", addr, port))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPTap{conn: conn}, nil
+}
+
+// WriteRTP marshals pkt and sends it as one datagram.
+func (t *UDPTap) WriteRTP(pkt *rtp.Packet) error {
+	b, err := pkt.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = t.conn.Write(b)
+	return err
+}
+
+// Close releases the underlying UDP socket.
+func (t *UDPTap) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,177 @@
+package healer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/LacavaDev/mitra-rtp-healer/helper"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// rtpExtensionHeaderSize is the profile and length words preceding the
+	// header extensions of an RTP packet (RFC 8285).
+	rtpExtensionHeaderSize = 4
+	// headerExtensionBudget is the room kept for each negotiated header
+	// extension: a one-byte element header and up to 7 bytes of data, enough
+	// for abs-send-time, transport-cc and short mid/rid values.
+	headerExtensionBudget = 8
+)
+
+// HealingTrack is a webrtc.TrackLocal fed with the raw camera packets: WriteRTP
+// heals them and every PeerConnection the track is added to receives the
+// result with its own sequence numbers, SSRC and payload type. Packets are
+// sized for each binding from the healer MTU minus the room kept for the
+// header extensions negotiated on it, since pion adds them after the track.
+//
+// Bindings are subscriptions of the track healer: a PeerConnection added late
+// replays the GOP cache when the healer has one (WithGOPCache), and a slow one
+// does not delay the others.
+type HealingTrack struct {
+	track  *webrtc.TrackLocalStaticRTP
+	healer *H264Healer
+
+	mu       sync.Mutex
+	bindings map[string]*trackBinding
+}
+
+// trackBinding is the subscription feeding one PeerConnection.
+type trackBinding struct {
+	ssrc uint32
+	sub  *Subscription
+}
+
+// NewHealingTrack creates an H.264 track healing with a healer configured by
+// opts. WithMTU sets the packet size header extensions included, as long as
+// each extension fits in its budget of 8 bytes. WithJitterBuffer is rejected:
+// nothing would Poll the healer, so packets would wait for the next write.
+func NewHealingTrack(c webrtc.RTPCodecCapability, id string, streamID string, opts ...Option) (*HealingTrack, error) {
+	if !strings.EqualFold(c.MimeType, webrtc.MimeTypeH264) {
+		return nil, fmt.Errorf("%w: %s", helper.ErrUnsupportedCodec, c.MimeType)
+	}
+	h := NewH264Healer(opts...)
+	if h.jitter != nil {
+		return nil, fmt.Errorf("%w: WithJitterBuffer in a HealingTrack", helper.ErrUnsupportedOption)
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(c, id, streamID)
+	if err != nil {
+		return nil, err
+	}
+	return &HealingTrack{
+		track:    track,
+		healer:   h,
+		bindings: make(map[string]*trackBinding),
+	}, nil
+}
+
+// Bind implements webrtc.TrackLocal. The codec is negotiated like for a
+// TrackLocalStaticRTP.
+func (t *HealingTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.track.Bind(ctx)
+	if err != nil {
+		return codec, err
+	}
+
+	sink := &bindingSink{
+		ssrc:        uint32(ctx.SSRC()),
+		payloadType: uint8(codec.PayloadType),
+		writer:      ctx.WriteStream(),
+	}
+	mtu := t.healer.mtu
+	if exts := ctx.HeaderExtensions(); len(exts) > 0 {
+		mtu -= rtpExtensionHeaderSize + len(exts)*headerExtensionBudget
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bindings[ctx.ID()] = &trackBinding{
+		ssrc: sink.ssrc,
+		sub:  t.healer.Subscribe(sink, WithSubscriberMTU(mtu)),
+	}
+	return codec, nil
+}
+
+// Unbind implements webrtc.TrackLocal.
+func (t *HealingTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.mu.Lock()
+	binding, ok := t.bindings[ctx.ID()]
+	delete(t.bindings, ctx.ID())
+	t.mu.Unlock()
+
+	if ok {
+		binding.sub.Close()
+	}
+	return t.track.Unbind(ctx)
+}
+
+// WriteRTP heals pkt and queues the result for every binding. The packet is
+// copied, so the caller may reuse it. Errors are those of H264Healer.Push:
+// the healed packets are delivered anyway.
+func (t *HealingTrack) WriteRTP(pkt *rtp.Packet) error {
+	clone := &rtp.Packet{Header: pkt.Header.Clone(), Payload: append([]byte(nil), pkt.Payload...)}
+	_, err := t.healer.Push(clone)
+	return err
+}
+
+// Write unmarshals b as one RTP packet and heals it like WriteRTP.
+func (t *HealingTrack) Write(b []byte) (int, error) {
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return len(b), t.WriteRTP(pkt)
+}
+
+// HandleRTCP handles the PLI and FIR read from the RTPSender of the track
+// (RTPSender.ReadRTCP): the PeerConnection that sent them is served like with
+// Subscription.HandleRTCP.
+func (t *HealingTrack) HandleRTCP(pkts []rtcp.Packet) {
+	t.mu.Lock()
+	bindings := make([]*trackBinding, 0, len(t.bindings))
+	for _, binding := range t.bindings {
+		bindings = append(bindings, binding)
+	}
+	t.mu.Unlock()
+
+	for _, binding := range bindings {
+		pli, fir := keyframeRequests(pkts, func(ssrc uint32) bool { return ssrc == binding.ssrc })
+		binding.sub.keyframeRequested(pli, fir)
+	}
+}
+
+// Healer returns the healer of the track, for its stats and callbacks.
+func (t *HealingTrack) Healer() *H264Healer {
+	return t.healer
+}
+
+// ID implements webrtc.TrackLocal.
+func (t *HealingTrack) ID() string { return t.track.ID() }
+
+// RID implements webrtc.TrackLocal.
+func (t *HealingTrack) RID() string { return t.track.RID() }
+
+// StreamID implements webrtc.TrackLocal.
+func (t *HealingTrack) StreamID() string { return t.track.StreamID() }
+
+// Kind implements webrtc.TrackLocal.
+func (t *HealingTrack) Kind() webrtc.RTPCodecType { return t.track.Kind() }
+
+// Codec returns the codec capability of the track.
+func (t *HealingTrack) Codec() webrtc.RTPCodecCapability { return t.track.Codec() }
+
+// bindingSink writes the packets of one subscription to a PeerConnection.
+type bindingSink struct {
+	ssrc        uint32
+	payloadType uint8
+	writer      webrtc.TrackLocalWriter
+}
+
+func (s *bindingSink) WriteRTP(pkt *rtp.Packet) error {
+	pkt.SSRC = s.ssrc
+	pkt.PayloadType = s.payloadType
+	_, err := s.writer.WriteRTP(&pkt.Header, pkt.Payload)
+	return err
+}
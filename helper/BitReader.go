@@ -0,0 +1,155 @@
+package helper
+
+import "fmt"
+
+// RemoveEmulationPrevention converts a NAL unit into its RBSP by dropping the
+// emulation_prevention_three_byte of every 0x000003 sequence (H.264 7.4.1).
+func RemoveEmulationPrevention(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// BitReader reads the fixed and exp-Golomb coded fields of an RBSP (H.264 9.1).
+// Reads past the end return an error wrapping ErrMalformedBitstream.
+type BitReader struct {
+	data []byte
+	pos  int
+}
+
+// NewBitReader reads rbsp from its first bit. Use RemoveEmulationPrevention
+// beforehand when starting from a NAL unit.
+func NewBitReader(rbsp []byte) *BitReader {
+	return &BitReader{data: rbsp}
+}
+
+// BitsLeft returns how many bits have not been read yet.
+func (r *BitReader) BitsLeft() int {
+	return len(r.data)*8 - r.pos
+}
+
+// ReadBit reads u(1).
+func (r *BitReader) ReadBit() (uint32, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, fmt.Errorf("%w: read past end at bit %d", ErrMalformedBitstream, r.pos)
+	}
+	bit := (r.data[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+	r.pos++
+	return uint32(bit), nil
+}
+
+// ReadFlag reads u(1) as a bool.
+func (r *BitReader) ReadFlag() (bool, error) {
+	bit, err := r.ReadBit()
+	return bit == 1, err
+}
+
+// ReadBits reads u(n) for n up to 32.
+func (r *BitReader) ReadBits(n int) (uint32, error) {
+	if n < 0 || n > 32 {
+		return 0, fmt.Errorf("%w: cannot read %d bits at once", ErrMalformedBitstream, n)
+	}
+	if n > r.BitsLeft() {
+		return 0, fmt.Errorf("%w: %d bits requested, %d left", ErrMalformedBitstream, n, r.BitsLeft())
+	}
+	var v uint32
+	for i := 0; i < n; i++ {
+		bit, _ := r.ReadBit()
+		v = v<<1 | bit
+	}
+	return v, nil
+}
+
+// Skip discards n bits.
+func (r *BitReader) Skip(n int) error {
+	if n > r.BitsLeft() {
+		return fmt.Errorf("%w: cannot skip %d bits, %d left", ErrMalformedBitstream, n, r.BitsLeft())
+	}
+	r.pos += n
+	return nil
+}
+
+// ReadUE reads an unsigned exp-Golomb value ue(v).
+func (r *BitReader) ReadUE() (uint32, error) {
+	leadingZeros := 0
+	for {
+		bit, err := r.ReadBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		leadingZeros++
+		if leadingZeros > 31 {
+			return 0, fmt.Errorf("%w: exp-Golomb code longer than 32 bits", ErrMalformedBitstream)
+		}
+	}
+	suffix, err := r.ReadBits(leadingZeros)
+	if err != nil {
+		return 0, err
+	}
+	return uint32((uint64(1)<<leadingZeros)-1) + suffix, nil
+}
+
+// ReadSE reads a signed exp-Golomb value se(v).
+func (r *BitReader) ReadSE() (int32, error) {
+	k, err := r.ReadUE()
+	if err != nil {
+		return 0, err
+	}
+	if k%2 == 1 {
+		return int32((k + 1) / 2), nil
+	}
+	return -int32(k / 2), nil
+}
+
+// stickyReader keeps the first error of a BitReader so long syntax tables can
+// be parsed without checking every field; the error is checked once at the end.
+type stickyReader struct {
+	r   *BitReader
+	err error
+}
+
+func (s *stickyReader) u(n int) uint32 {
+	if s.err != nil {
+		return 0
+	}
+	v, err := s.r.ReadBits(n)
+	s.err = err
+	return v
+}
+
+func (s *stickyReader) flag() bool {
+	return s.u(1) == 1
+}
+
+func (s *stickyReader) ue() uint32 {
+	if s.err != nil {
+		return 0
+	}
+	v, err := s.r.ReadUE()
+	s.err = err
+	return v
+}
+
+func (s *stickyReader) se() int32 {
+	if s.err != nil {
+		return 0
+	}
+	v, err := s.r.ReadSE()
+	s.err = err
+	return v
+}
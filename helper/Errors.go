@@ -0,0 +1,81 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors returned by the helper package. They are always wrapped, so
+// compare them with errors.Is and extract details with errors.As.
+var (
+	ErrEmptyFUASequence     = errors.New("empty FU-A sequence")
+	ErrMissingStartFragment = errors.New("FU-A sequence without start fragment")
+	ErrMissingEndFragment   = errors.New("FU-A sequence without end fragment")
+	ErrMissingFragment      = errors.New("FU-A sequence with missing fragments")
+	ErrReassemblyTimeout    = errors.New("FU-A reassembly timed out")
+	ErrNalTypeMismatch      = errors.New("FU-A NAL type mismatch")
+	ErrSSRCMismatch         = errors.New("FU-A SSRC mismatch")
+	ErrTimestampMismatch    = errors.New("FU-A timestamp mismatch")
+	ErrForbiddenBitMismatch = errors.New("FU-A forbidden bit mismatch")
+	ErrMissingParameterSets = errors.New("stream without SPS/PPS parameter sets")
+	ErrPayloadTooShort      = errors.New("RTP payload too short")
+	ErrMalformedPayload     = errors.New("malformed RTP payload")
+	ErrInvalidMTU           = errors.New("invalid maximum NALU size")
+	ErrMalformedBitstream   = errors.New("malformed H.264 bitstream")
+	ErrBufferOverflow       = errors.New("buffer limit exceeded")
+	ErrUnsupportedCodec     = errors.New("unsupported codec")
+	ErrUnsupportedOption    = errors.New("unsupported option")
+)
+
+// FUASequenceError describes why a FU-A sequence was rejected.
+// Index is the position of the offending fragment, or -1 when the error
+// concerns the sequence as a whole (start/end fragment counts).
+type FUASequenceError struct {
+	Err      error
+	Index    int
+	Got      uint32
+	Expected uint32
+}
+
+func (e *FUASequenceError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("%v: found %d (expected %d)", e.Err, e.Got, e.Expected)
+	}
+	return fmt.Sprintf("%v: packet %d has %d (expected %d)", e.Err, e.Index, e.Got, e.Expected)
+}
+
+func (e *FUASequenceError) Unwrap() error {
+	return e.Err
+}
+
+// PayloadError reports a payload that is too short for the structure being parsed.
+type PayloadError struct {
+	NalType byte
+	Length  int
+	Needed  int
+}
+
+func (e *PayloadError) Error() string {
+	return fmt.Sprintf("%v: NAL type %d has %d bytes (needs %d)", ErrPayloadTooShort, e.NalType, e.Length, e.Needed)
+}
+
+func (e *PayloadError) Unwrap() error {
+	return ErrPayloadTooShort
+}
+
+// OverflowError reports a buffer that grew past its limit. The buffered data
+// has been dropped when it is returned.
+type OverflowError struct {
+	// Limit names the limit that was hit, such as "NALU size" or "buffered packets".
+	Limit string
+	Size  int
+	Max   int
+}
+
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("%v: %s %d exceeds %d", ErrBufferOverflow, e.Limit, e.Size, e.Max)
+}
+
+func (e *OverflowError) Unwrap() error {
+	return ErrBufferOverflow
+}
@@ -2,9 +2,8 @@ package helper
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"math"
-	"net"
 	"os"
 
 	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
@@ -61,7 +60,7 @@ import (
 func SaveFuHeadersToFile(packets [][]byte, filename string, le int) error {
 	file, err := os.Create(filename)
 	if err != nil {
-		return fmt.Errorf("erro ao criar arquivo: %w", err)
+		return fmt.Errorf("error creating FU headers file: %w", err)
 	}
 	defer file.Close()
 	totalLen := 0
@@ -70,7 +69,7 @@ func SaveFuHeadersToFile(packets [][]byte, filename string, le int) error {
 	}
 	for i, pkt := range packets {
 		if len(pkt) < 2 {
-			continue // pula pacotes inválidos
+			continue // skip invalid packets
 		}
 
 		fuIndicator := pkt[0]
@@ -82,28 +81,28 @@ func SaveFuHeadersToFile(packets [][]byte, filename string, le int) error {
 			i, fuIndicator, fuIndicator, fuHeader, fuHeader, len(pkt), totalLen, le,
 		)
 		if err != nil {
-			return fmt.Errorf("erro ao escrever no arquivo: %w", err)
+			return fmt.Errorf("error writing FU headers file: %w", err)
 		}
 	}
 
 	return nil
 }
 
-func FragmentSingleNaluToFUAPackets(nalu rtp.Packet, expectedNaluSize int, lastSequence *uint16) ([]*rtp.Packet, error) {
-	headerBytes, _ := nalu.Header.Marshal()
-
-	totalNaluLength, _ := NaluExceedsMTU(headerBytes, nalu.Payload, expectedNaluSize)
-
-	var calculateDecimalPart = func() int {
-		newPacketsDecimalQtd := float64(totalNaluLength) / float64(expectedNaluSize)
-
-		_, decimalPart := math.Modf(newPacketsDecimalQtd)
-
-		if decimalPart != 0 {
-			newPacketsDecimalQtd++
-		}
-		newPacketsQtd := int(newPacketsDecimalQtd)
-		return newPacketsQtd
+// FragmentSingleNaluToFUAPackets splits a single NALU packet into FU-A
+// fragments carrying at most expectedNaluSize bytes of the NALU each. Only the
+// last fragment may carry the marker bit, and only if the NALU packet had it:
+// the marker flags the end of an access unit, not the end of every NALU.
+// Fragments are numbered consecutively from the sequence number of nalu, so
+// they pass ValidateFUASequence; the final numbering is up to the sender.
+func FragmentSingleNaluToFUAPackets(nalu rtp.Packet, expectedNaluSize int) ([]*rtp.Packet, error) {
+	if len(nalu.Payload) < 1 {
+		return nil, &PayloadError{Length: 0, Needed: 1}
+	}
+	if expectedNaluSize < 1 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidMTU, expectedNaluSize)
+	}
+	if nalType := nalu.Payload[0] & 0x1F; nalType < 1 || nalType > 23 {
+		return nil, fmt.Errorf("%w: NAL type %d cannot be carried in FU-A", ErrMalformedPayload, nalType)
 	}
 
 	var buildFuAIndicatorFromSingleNaluHeader = func() byte {
@@ -113,87 +112,51 @@ func FragmentSingleNaluToFUAPackets(nalu rtp.Packet, expectedNaluSize int, lastS
 		return sampleHeaderNaluHeader
 	}
 
-	var buildFuAHeader = func(packetType string) byte {
-		result := byte(0)
-		originalNalType := nalu.Payload[0] & 0x1F
-		switch packetType {
-		case "start":
+	var buildFuAHeader = func(first bool, last bool) byte {
+		result := nalu.Payload[0] & 0b00011111
+		if first {
 			result |= 0x80
-		case "end":
+		}
+		if last {
 			result |= 0x40
-		default:
-			result &^= 0xC0
 		}
-
-		result = (result & 0b11100000) | (originalNalType & 0b00011111)
-
 		return result
 	}
 
-	newPacketsQtd := calculateDecimalPart()
-
-	var result []*rtp.Packet = []*rtp.Packet{}
 	originalPayload := nalu.Payload[1:]
-
-	if len(originalPayload) < expectedNaluSize {
-		newPacketsQtd = 1
+	originalLength := len(originalPayload)
+	if originalLength < 2 {
+		// a start and an end fragment need one byte each
+		return nil, &PayloadError{NalType: nalu.Payload[0] & 0x1F, Length: len(nalu.Payload), Needed: 3}
 	}
 
-	var lastBytePos int = 0
-	offset := 0
-	originalLength := len(originalPayload)
-	expectedMaxLength := originalLength
+	chunkSize := expectedNaluSize
+	if originalLength <= chunkSize {
+		// the NALU only exceeds once the RTP header is counted: split it in two
+		// so the start and end bits land on different fragments (RFC 6184 5.8)
+		chunkSize = (originalLength + 1) / 2
+	}
 
-	//precisaremos add 2 bytes de FUAI e FUAH para cada pacote
-	expectedMaxLength += int(newPacketsQtd) * 2
 	fuIndicator := buildFuAIndicatorFromSingleNaluHeader()
+	result := make([]*rtp.Packet, 0, (originalLength+chunkSize-1)/chunkSize)
 
-	for offset < int(newPacketsQtd) {
-		var lastOffset = offset == int(newPacketsQtd)-1
-		var firstOffset = offset == 0
-		if lastBytePos > originalLength {
-			lastOffset = true
-			lastBytePos = originalLength - (lastBytePos - originalLength)
-		}
-
-		packetOrderType := ""
-
-		if firstOffset {
-			packetOrderType = "start"
-		} else if lastOffset {
-			packetOrderType = "end"
-		} else {
-			packetOrderType = "middle"
-		}
-
-		fuHeader := buildFuAHeader(packetOrderType)
+	for offset := 0; offset < originalLength; offset += chunkSize {
+		limit := min(offset+chunkSize, originalLength)
+		firstOffset := offset == 0
+		lastOffset := limit == originalLength
 
-		limit := expectedNaluSize * (offset + 1)
-		if limit > len(originalPayload) {
-			limit = len(originalPayload)
-		}
-
-		sub := []byte{fuIndicator, fuHeader}
-		if lastOffset {
-			sub = append(sub, originalPayload[lastBytePos:]...)
-		} else {
-			sub = append(sub, originalPayload[lastBytePos:limit]...)
-		}
+		sub := make([]byte, 0, 2+limit-offset)
+		sub = append(sub, fuIndicator, buildFuAHeader(firstOffset, lastOffset))
+		sub = append(sub, originalPayload[offset:limit]...)
 
 		newHeader := nalu.Header.Clone()
-		if lastOffset {
-			newHeader.Marker = true
-		} else {
-			newHeader.Marker = false
-		}
-		packet := rtp.Packet{
-			Payload: sub,
-			Header:  newHeader,
-		}
+		newHeader.Marker = lastOffset && nalu.Header.Marker
+		newHeader.SequenceNumber = nalu.SequenceNumber + uint16(len(result))
 
-		result = append(result, &packet)
-		lastBytePos += expectedNaluSize
-		offset++
+		result = append(result, &rtp.Packet{
+			Header:  newHeader,
+			Payload: sub,
+		})
 	}
 
 	return result, nil
@@ -210,7 +173,13 @@ func DebugNaluFUAInfo(nalu healerTypes.NaluInfo) {
 	fmt.Printf("║ End Bit              │ %-30v ║\n", nalu.EndBit)
 	fmt.Printf("║ Original NAL Type    │ %-30d ║\n", nalu.OriginalNalType)
 	fmt.Printf("║ FU Header Byte       │ %-30d ║\n", nalu.FuHeader)
-	fmt.Printf("║ Last Sequence Ptr    │ %-30d ║\n", nalu.LastSequence)
+	fmt.Printf("║ NRI                  │ %-30d ║\n", nalu.NRI)
+	if nalu.Slice != nil {
+		fmt.Printf("║ First MB In Slice    │ %-30d ║\n", nalu.Slice.FirstMbInSlice)
+		fmt.Printf("║ Slice Type           │ %-30d ║\n", nalu.Slice.SliceType)
+		fmt.Printf("║ PPS Id               │ %-30d ║\n", nalu.Slice.PPSID)
+		fmt.Printf("║ Frame Num            │ %-30d ║\n", nalu.Slice.FrameNum)
+	}
 
 	fmt.Printf("╟──────────────────────┼────────────────────────────────╢\n")
 	fmt.Printf("║ SPS (base64)         │ %-30s ║\n", base64.StdEncoding.EncodeToString(nalu.Sps))
@@ -219,77 +188,140 @@ func DebugNaluFUAInfo(nalu healerTypes.NaluInfo) {
 	fmt.Println("╚══════════════════════╧════════════════════════════════╝")
 }
 
-func sendRTPPackets(addr string, port int, packets [][]byte) error {
-	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", addr, port))
-	if err != nil {
-		return err
-	}
+const (
+	// DefaultMaxNaluSize caps the size of a NALU rebuilt from FU-A fragments.
+	DefaultMaxNaluSize = 4 << 20
+	// DefaultMaxBufferedPackets caps the number of FU-A fragments queued at once.
+	DefaultMaxBufferedPackets = 4096
+)
 
-	conn, err := net.DialUDP("udp", nil, udpAddr)
-	if err != nil {
-		return err
+// CheckFUAQueueLimits reports whether appending pkt to naluQeue would exceed
+// maxPackets fragments or a rebuilt NALU of maxNaluSize bytes.
+func CheckFUAQueueLimits(naluQeue []*rtp.Packet, pkt *rtp.Packet, maxPackets int, maxNaluSize int) error {
+	if count := len(naluQeue) + 1; count > maxPackets {
+		return &OverflowError{Limit: "buffered packets", Size: count, Max: maxPackets}
 	}
-	defer conn.Close()
-
-	for _, pkt := range packets {
-		_, err := conn.Write(pkt)
-		if err != nil {
-			return err
-		}
+	// the NAL header is rebuilt from the FU indicator and header (2 bytes)
+	size := 1 + max(len(pkt.Payload)-2, 0)
+	for _, fragment := range naluQeue {
+		size += max(len(fragment.Payload)-2, 0)
+	}
+	if size > maxNaluSize {
+		return &OverflowError{Limit: "NALU size", Size: size, Max: maxNaluSize}
 	}
-
 	return nil
 }
 
-func MakeFUAStreamApproach(exceeds bool, naluChan chan *rtp.Packet, allNaluInfo *healerTypes.NaluInfo, naluQeue *[]*rtp.Packet, collecting *bool, maxNaluSize int) {
+// MakeFUAStreamApproach collects FU-A fragments until the end fragment arrives,
+// rebuilds the NALU and re-fragments it with maxNaluSize. Packets are still
+// forwarded when validation fails; the error is returned so the caller can
+// account for it. Queued fragments are dropped as soon as a packet does not
+// continue them (lost end fragment, timestamp change or sequence gap), and that
+// packet is then handled on its own, and when they would exceed
+// DefaultMaxBufferedPackets or DefaultMaxNaluSize. Timeouts and configurable
+// limits need per-stream state: see the healer package.
+func MakeFUAStreamApproach(exceeds bool, naluChan chan *rtp.Packet, allNaluInfo *healerTypes.NaluInfo, naluQeue *[]*rtp.Packet, collecting *bool, maxNaluSize int) error {
+
+	if *collecting {
+		if err := fragmentContinues(*naluQeue, allNaluInfo); err != nil {
+			*naluQeue = (*naluQeue)[:0]
+			*collecting = false
+			return errors.Join(err, MakeFUAStreamApproach(exceeds, naluChan, allNaluInfo, naluQeue, collecting, maxNaluSize))
+		}
+	}
 
 	if !exceeds && !*collecting {
-		StapAVerification(*allNaluInfo, naluChan)
+		err := StapAVerification(*allNaluInfo, naluChan)
 		naluChan <- allNaluInfo.Pkt
-		return
+		return err
 	}
 
 	if exceeds && allNaluInfo.StartBit {
 		*collecting = true
 		*naluQeue = append(*naluQeue, allNaluInfo.Pkt)
-		return
+		return nil
 	}
 
-	if *collecting {
-		*naluQeue = append(*naluQeue, allNaluInfo.Pkt)
-
-		if allNaluInfo.EndBit {
-			*collecting = false
-			var infos []*healerTypes.NaluInfo
+	if !*collecting {
+		return &FUASequenceError{Err: ErrMissingStartFragment, Index: -1, Got: 0, Expected: 1}
+	}
 
-			for _, nalu := range *naluQeue {
-				info := RetrieveNaluInfo(nalu, allNaluInfo.Sps, allNaluInfo.Pps, &nalu.SequenceNumber, allNaluInfo.Track)
-				infos = append(infos, &info)
-			}
+	if err := CheckFUAQueueLimits(*naluQeue, allNaluInfo.Pkt, DefaultMaxBufferedPackets, DefaultMaxNaluSize); err != nil {
+		*naluQeue = (*naluQeue)[:0]
+		*collecting = false
+		return err
+	}
+	*naluQeue = append(*naluQeue, allNaluInfo.Pkt)
 
-			newPkt, _ := BuildSingleNaluFromFUAPackets(infos, allNaluInfo.LastSequence)
+	if !allNaluInfo.EndBit {
+		return nil
+	}
+	*collecting = false
 
+	var infos []*healerTypes.NaluInfo
+	for _, nalu := range *naluQeue {
+		info, err := RetrieveNaluInfo(nalu, allNaluInfo.Sps, allNaluInfo.Pps, allNaluInfo.Track)
+		if err != nil {
 			*naluQeue = (*naluQeue)[:0]
+			return err
+		}
+		infos = append(infos, &info)
+	}
+	*naluQeue = (*naluQeue)[:0]
+
+	newPkt, err := BuildSingleNaluFromFUAPackets(infos)
+	if err != nil {
+		return err
+	}
 
-			pkts, _ := FragmentSingleNaluToFUAPackets(*newPkt, maxNaluSize, allNaluInfo.LastSequence)
+	return fragmentAndForward(*newPkt, naluChan, allNaluInfo, maxNaluSize)
+}
 
-			var infos2 []*healerTypes.NaluInfo
-			for _, nalu := range pkts {
-				info := RetrieveNaluInfo(nalu, allNaluInfo.Sps, allNaluInfo.Pps, &nalu.SequenceNumber, allNaluInfo.Track)
-				infos2 = append(infos2, &info)
-			}
+// fragmentContinues checks that info is the next fragment of the FU-A queued in
+// naluQeue: a middle or end fragment with the same SSRC and timestamp and the
+// following sequence number.
+func fragmentContinues(naluQeue []*rtp.Packet, info *healerTypes.NaluInfo) error {
+	if len(naluQeue) == 0 {
+		return nil
+	}
+	last := naluQeue[len(naluQeue)-1]
+	pkt := info.Pkt
 
-			err := ValidateFUASequence(infos2)
-			if err != nil {
-				fmt.Println(err)
-			}
+	if info.FuHeader == 0 || info.StartBit || pkt.SSRC != last.SSRC || pkt.Timestamp != last.Timestamp {
+		return &FUASequenceError{Err: ErrMissingEndFragment, Index: -1, Got: 0, Expected: 1}
+	}
+	if expected := last.SequenceNumber + 1; pkt.SequenceNumber != expected {
+		return &FUASequenceError{Err: ErrMissingFragment, Index: len(naluQeue), Got: uint32(pkt.SequenceNumber), Expected: uint32(expected)}
+	}
+	return nil
+}
 
-			StapAVerification(*infos2[0], naluChan)
+// fragmentAndForward re-fragments a complete NALU, validates the result and
+// forwards it, preceded by a STAP-A when it is an IDR.
+func fragmentAndForward(nalu rtp.Packet, naluChan chan *rtp.Packet, allNaluInfo *healerTypes.NaluInfo, maxNaluSize int) error {
+	pkts, err := FragmentSingleNaluToFUAPackets(nalu, maxNaluSize)
+	if err != nil {
+		return err
+	}
 
-			for _, d := range pkts {
-				naluChan <- d
-			}
+	var infos []*healerTypes.NaluInfo
+	for _, pkt := range pkts {
+		info, err := RetrieveNaluInfo(pkt, allNaluInfo.Sps, allNaluInfo.Pps, allNaluInfo.Track)
+		if err != nil {
+			return err
 		}
+		infos = append(infos, &info)
 	}
 
+	validationErr := ValidateFUASequence(infos)
+	stapAErr := StapAVerification(*infos[0], naluChan)
+
+	for _, pkt := range pkts {
+		naluChan <- pkt
+	}
+
+	if validationErr != nil {
+		return validationErr
+	}
+	return stapAErr
 }
@@ -0,0 +1,51 @@
+package helper
+
+import (
+	"bytes"
+	"testing"
+
+	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
+	"github.com/pion/rtp"
+)
+
+func FuzzFragmentSingleNaluToFUAPackets(f *testing.F) {
+	f.Add(testIDR, 4, true)
+	f.Add(testSlice, 1, false)
+	f.Add(testIDR, 1200, true)
+	f.Add([]byte{0x65, 0x01}, 1, false)
+	f.Add([]byte{0x78, 0x00, 0x01}, 1, false)
+	f.Add([]byte{0x65}, 0, true)
+
+	f.Fuzz(func(t *testing.T, nalu []byte, size int, marker bool) {
+		header := rtp.Header{Version: 2, SequenceNumber: 65534, Timestamp: 3000, Marker: marker}
+		pkts, err := FragmentSingleNaluToFUAPackets(rtp.Packet{Header: header, Payload: nalu}, size)
+		if err != nil {
+			return
+		}
+
+		fragments := make([]*healerTypes.NaluInfo, len(pkts))
+		for i, pkt := range pkts {
+			if len(pkt.Payload) > size+2 {
+				t.Fatalf("fragment %d carries %d bytes, limit %d", i, len(pkt.Payload)-2, size)
+			}
+			if pkt.Marker != (marker && i == len(pkts)-1) {
+				t.Fatalf("fragment %d has marker %v", i, pkt.Marker)
+			}
+			info, err := RetrieveNaluInfo(pkt, nil, nil, nil)
+			if err != nil {
+				t.Fatalf("fragment %d: %v", i, err)
+			}
+			fragments[i] = &info
+		}
+		if err := ValidateFUASequence(fragments); err != nil {
+			t.Fatal(err)
+		}
+		rebuilt, err := BuildSingleNaluFromFUAPackets(fragments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rebuilt.Payload, nalu) {
+			t.Fatalf("rebuilt %x, want %x", rebuilt.Payload, nalu)
+		}
+	})
+}
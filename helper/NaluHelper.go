@@ -1,7 +1,6 @@
 package helper
 
 import (
-	"errors"
 	"fmt"
 	"sort"
 
@@ -10,6 +9,8 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
+// SortRTPPacketsBySequence sorts pkts in sequence number order, wrap-around
+// included, as long as they span less than half the sequence number space.
 func SortRTPPacketsBySequence(pkts []*rtp.Packet) []*rtp.Packet {
 	sort.SliceStable(pkts, func(i, j int) bool {
 		a := pkts[i].SequenceNumber
@@ -27,9 +28,17 @@ func NaluExceedsMTU(headerBytes []byte, payload []byte, expectedNaluSize int) (i
 	return totalNaluLength, totalNaluLength > expectedNaluSize
 }
 
+// ValidateFUASequence checks that the fragments belong to one NALU, follow
+// each other without sequence number gaps, agree on the F bit and carry
+// exactly one start and one end fragment. A fragment flagged with F=1 while
+// the others are not fails with ErrForbiddenBitMismatch: the NALU is complete
+// but damaged, and BuildSingleNaluFromFUAPackets would rebuild it with F=1.
+//
+// The returned error wraps one of the package sentinels (ErrSSRCMismatch,
+// ErrMissingFragment, ErrMissingStartFragment, ...).
 func ValidateFUASequence(nalus []*healerTypes.NaluInfo) error {
 	if len(nalus) == 0 {
-		return errors.New("empty FU-A sequence")
+		return ErrEmptyFUASequence
 	}
 
 	var (
@@ -42,15 +51,23 @@ func ValidateFUASequence(nalus []*healerTypes.NaluInfo) error {
 
 	for i, n := range nalus {
 		if n.OriginalNalType != expectedNalType {
-			return fmt.Errorf("inconsistency: packet %d has NAL type %d (expected %d)", i, n.OriginalNalType, expectedNalType)
+			return &FUASequenceError{Err: ErrNalTypeMismatch, Index: i, Got: uint32(n.OriginalNalType), Expected: uint32(expectedNalType)}
 		}
 
 		if n.Pkt.SSRC != expectedSSRC {
-			return fmt.Errorf("inconsistency: packet %d has SSRC %d (expected %d)", i, n.Pkt.SSRC, expectedSSRC)
+			return &FUASequenceError{Err: ErrSSRCMismatch, Index: i, Got: n.Pkt.SSRC, Expected: expectedSSRC}
 		}
 
 		if n.Pkt.Timestamp != expectedTS {
-			return fmt.Errorf("inconsistency: packet %d has timestamp %d (expected %d)", i, n.Pkt.Timestamp, expectedTS)
+			return &FUASequenceError{Err: ErrTimestampMismatch, Index: i, Got: n.Pkt.Timestamp, Expected: expectedTS}
+		}
+
+		if n.ForbiddenBit != nalus[0].ForbiddenBit {
+			return &FUASequenceError{Err: ErrForbiddenBitMismatch, Index: i, Got: boolToUint32(n.ForbiddenBit), Expected: boolToUint32(nalus[0].ForbiddenBit)}
+		}
+
+		if expectedSeq := nalus[0].Pkt.SequenceNumber + uint16(i); n.Pkt.SequenceNumber != expectedSeq {
+			return &FUASequenceError{Err: ErrMissingFragment, Index: i, Got: uint32(n.Pkt.SequenceNumber), Expected: uint32(expectedSeq)}
 		}
 
 		if n.StartBit {
@@ -59,23 +76,26 @@ func ValidateFUASequence(nalus []*healerTypes.NaluInfo) error {
 		if n.EndBit {
 			endCount++
 		}
-
-		if !n.StartBit && !n.EndBit && len(nalus) > 2 && (i != 0 && i != len(nalus)-1) {
-			continue
-		}
 	}
 
 	if startCount != 1 {
-		return fmt.Errorf("expected 1 packet with StartBit=true, but found %d", startCount)
+		return &FUASequenceError{Err: ErrMissingStartFragment, Index: -1, Got: uint32(startCount), Expected: 1}
 	}
 
 	if endCount != 1 {
-		return fmt.Errorf("expected 1 packet with EndBit=true, but found %d", endCount)
+		return &FUASequenceError{Err: ErrMissingEndFragment, Index: -1, Got: uint32(endCount), Expected: 1}
 	}
 
 	return nil
 }
 
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func HasDifferentNalTypes(pkts []*rtp.Packet) (bool, map[uint8]int) {
 	nalTypes := make(map[uint8]int)
 
@@ -102,7 +122,7 @@ func HasDifferentNalTypes(pkts []*rtp.Packet) (bool, map[uint8]int) {
 }
 
 func GetNALType(pkt *rtp.Packet) int {
-	if len(pkt.Payload) == 0 {
+	if pkt == nil || len(pkt.Payload) == 0 {
 		return -1
 	}
 	return int(pkt.Payload[0] & 0x1F)
@@ -119,29 +139,53 @@ func DebugLastPacketInfo(naluQueue []*rtp.Packet) string {
 	return ret
 }
 
-func RetrieveNaluInfo(pkt *rtp.Packet, sps []byte, pps []byte, lastSequence *uint16, track *webrtc.TrackLocalStaticRTP) healerTypes.NaluInfo {
+// RetrieveNaluInfo parses the NAL unit header, and the FU header for FU-A
+// packets. Truncated or garbled payloads return a *PayloadError or an error
+// wrapping ErrMalformedPayload instead of panicking. The slice header of a
+// single NAL unit or start fragment is parsed with sps and pps, which are
+// decoded on every such call: pass nil when NaluInfo.Slice is not needed.
+func RetrieveNaluInfo(pkt *rtp.Packet, sps []byte, pps []byte, track *webrtc.TrackLocalStaticRTP) (healerTypes.NaluInfo, error) {
+	if pkt == nil || len(pkt.Payload) < 1 {
+		return healerTypes.NaluInfo{}, &PayloadError{Length: 0, Needed: 1}
+	}
 
 	if isFUA := (pkt.Payload[0] & 0x1F) == 28; isFUA {
+		if len(pkt.Payload) < 2 {
+			return healerTypes.NaluInfo{}, &PayloadError{NalType: 28, Length: len(pkt.Payload), Needed: 2}
+		}
+
 		fuHeader := pkt.Payload[1]
 		startBit := (fuHeader & 0x80) != 0
 		endBit := (fuHeader & 0x40) != 0
 		originalNalType := fuHeader & 0x1F
 		isIDR := originalNalType == 5
 
+		if startBit && endBit {
+			return healerTypes.NaluInfo{}, fmt.Errorf("%w: FU-A with both start and end bits set", ErrMalformedPayload)
+		}
+		if originalNalType == 0 || originalNalType > 23 {
+			return healerTypes.NaluInfo{}, fmt.Errorf("%w: FU-A carrying NAL type %d", ErrMalformedPayload, originalNalType)
+		}
+
 		allNaluInfo := healerTypes.NaluInfo{
 			Pkt:             pkt,
 			Track:           track,
 			Pps:             pps,
 			Sps:             sps,
-			LastSequence:    lastSequence,
 			StartBit:        startBit,
 			EndBit:          endBit,
 			IsIDR:           isIDR,
 			FuHeader:        fuHeader,
 			OriginalNalType: originalNalType,
+			NRI:             (pkt.Payload[0] >> 5) & 0x03,
+			ForbiddenBit:    pkt.Payload[0]&0x80 != 0,
+		}
+		if startBit {
+			header := (pkt.Payload[0] & 0xE0) | originalNalType
+			allNaluInfo.Slice = sliceHeaderFromInfo(append([]byte{header}, pkt.Payload[2:min(len(pkt.Payload), maxSliceHeaderBytes)]...), sps, pps)
 		}
 
-		return allNaluInfo
+		return allNaluInfo, nil
 	} else {
 		nalType := pkt.Payload[0] & 0x1F
 		isIDR := nalType == 5
@@ -151,15 +195,41 @@ func RetrieveNaluInfo(pkt *rtp.Packet, sps []byte, pps []byte, lastSequence *uin
 			Track:           track,
 			Pps:             pps,
 			Sps:             sps,
-			LastSequence:    lastSequence,
 			StartBit:        false,
 			EndBit:          false,
 			IsIDR:           isIDR,
 			FuHeader:        0,
 			OriginalNalType: nalType,
+			NRI:             (pkt.Payload[0] >> 5) & 0x03,
+			ForbiddenBit:    pkt.Payload[0]&0x80 != 0,
+			Slice:           sliceHeaderFromInfo(pkt.Payload, sps, pps),
 		}
-		return allNaluInfo
+		return allNaluInfo, nil
+	}
+}
+
+// sliceHeaderFromInfo parses the slice header of nalu with the raw parameter
+// sets carried by NaluInfo. It returns nil for non-slice NAL units or when the
+// header cannot be decoded: a broken slice header is not a packet error.
+func sliceHeaderFromInfo(nalu []byte, sps []byte, pps []byte) *healerTypes.SliceHeader {
+	if nalType := nalTypeOf(nalu); nalType != 1 && nalType != 5 {
+		return nil
+	}
+
+	var (
+		parsedSPS *healerTypes.SPS
+		parsedPPS *healerTypes.PPS
+	)
+	if len(sps) > 0 && len(pps) > 0 {
+		parsedSPS, _ = ParseSPS(sps)
+		parsedPPS, _ = ParsePPS(pps)
+	}
+
+	sh, err := ParseSliceHeader(nalu, parsedSPS, parsedPPS)
+	if err != nil {
+		return nil
 	}
+	return sh
 }
 
 func PrintRTPHeader(pkt *rtp.Packet) {
@@ -185,12 +255,11 @@ func PrintRTPHeader(pkt *rtp.Packet) {
 }
 
 // DecoderReset clears RTP header fields that might confuse the decoder,
-// specifically the Marker and Padding bits.
+// specifically the Padding bit.
 //
-// !!! Use this function only when using the FU-A or Single NALU approaches !!!
-// from the Mitra RTP Healer library, as these techniques require certain
-// bits to be reset for compatibility with video decoders.
+// The Marker bit is left untouched: receivers use it to finish frames, so it
+// must stay on the last packet of each access unit. The FU-A and Single NALU
+// approaches already keep it only on the last fragment of a marked NALU.
 func DecoderReset(pkt *rtp.Packet) {
-	pkt.Header.Marker = false
 	pkt.Header.Padding = false
 }
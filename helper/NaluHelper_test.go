@@ -0,0 +1,25 @@
+package helper
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func FuzzRetrieveNaluInfo(f *testing.F) {
+	f.Add(testIDR, true)
+	f.Add(testSlice, false)
+	f.Add(append([]byte{0x7c, 0x85}, testIDR[1:]...), true)
+	f.Add([]byte{0x7c, 0x45, 0x01}, false)
+	f.Add([]byte{0x38, 0x00, 0x01, 0x5c}, true)
+	f.Add([]byte{0x7c}, true)
+
+	f.Fuzz(func(t *testing.T, payload []byte, withSets bool) {
+		pkt := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: 1, Timestamp: 3000}, Payload: payload}
+		sps, pps := testSPS, testPPS
+		if !withSets {
+			sps, pps = nil, nil
+		}
+		_, _ = RetrieveNaluInfo(pkt, sps, pps, nil)
+	})
+}
@@ -0,0 +1,78 @@
+package helper
+
+import (
+	"fmt"
+
+	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
+)
+
+// ParsePPS decodes a PPS NAL unit up to redundant_pic_cnt_present_flag.
+func ParsePPS(nalu []byte) (*healerTypes.PPS, error) {
+	br, err := nalRBSPReader(nalu, 8)
+	if err != nil {
+		return nil, err
+	}
+	r := &stickyReader{r: br}
+	pps := &healerTypes.PPS{}
+
+	pps.ID = r.ue()
+	pps.SPSID = r.ue()
+	pps.EntropyCodingModeFlag = r.flag()
+	pps.BottomFieldPicOrderInFramePresent = r.flag()
+	pps.NumSliceGroups = r.ue() + 1
+	if pps.NumSliceGroups > 8 {
+		return nil, fmt.Errorf("%w: num_slice_groups %d", ErrMalformedBitstream, pps.NumSliceGroups)
+	}
+	if pps.NumSliceGroups > 1 {
+		skipSliceGroupMap(r, pps.NumSliceGroups)
+	}
+
+	pps.NumRefIdxL0DefaultActive = r.ue() + 1
+	pps.NumRefIdxL1DefaultActive = r.ue() + 1
+	pps.WeightedPred = r.flag()
+	pps.WeightedBipredIDC = r.u(2)
+	pps.PicInitQP = r.se() + 26
+	r.se() // pic_init_qs_minus26
+	r.se() // chroma_qp_index_offset
+	pps.DeblockingFilterControlPresent = r.flag()
+	pps.ConstrainedIntraPred = r.flag()
+	pps.RedundantPicCntPresent = r.flag()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if pps.ID > 255 || pps.SPSID > 31 {
+		return nil, fmt.Errorf("%w: parameter set ids %d/%d out of range", ErrMalformedBitstream, pps.ID, pps.SPSID)
+	}
+	return pps, nil
+}
+
+func skipSliceGroupMap(r *stickyReader, numSliceGroups uint32) {
+	switch mapType := r.ue(); mapType {
+	case 0:
+		for i := uint32(0); i < numSliceGroups; i++ {
+			r.ue() // run_length_minus1
+		}
+	case 2:
+		for i := uint32(0); i < numSliceGroups-1; i++ {
+			r.ue() // top_left
+			r.ue() // bottom_right
+		}
+	case 3, 4, 5:
+		r.u(1) // slice_group_change_direction_flag
+		r.ue() // slice_group_change_rate_minus1
+	case 6:
+		picSizeInMapUnits := r.ue() + 1
+		if picSizeInMapUnits > 1<<16 {
+			r.err = fmt.Errorf("%w: pic_size_in_map_units %d", ErrMalformedBitstream, picSizeInMapUnits)
+			return
+		}
+		bits := 0
+		for (uint32(1) << bits) < numSliceGroups {
+			bits++
+		}
+		for i := uint32(0); i < picSizeInMapUnits && r.err == nil; i++ {
+			r.u(bits) // slice_group_id
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package helper
+
+import "testing"
+
+// testPPS is PPS 0 referencing SPS 0, CAVLC, one slice group.
+var testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+
+func FuzzParsePPS(f *testing.F) {
+	f.Add(testPPS)
+	f.Add([]byte{0x68})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, nalu []byte) {
+		pps, err := ParsePPS(nalu)
+		if err == nil && pps == nil {
+			t.Fatal("nil PPS without an error")
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package helper
+
+import "fmt"
+
+// nalRBSPReader checks the NAL type and returns a reader positioned right after
+// the one byte NAL header.
+func nalRBSPReader(nalu []byte, nalTypes ...byte) (*BitReader, error) {
+	if len(nalu) < 2 {
+		return nil, &PayloadError{NalType: nalTypeOf(nalu), Length: len(nalu), Needed: 2}
+	}
+	nalType := nalu[0] & 0x1F
+	for _, expected := range nalTypes {
+		if nalType == expected {
+			return NewBitReader(RemoveEmulationPrevention(nalu[1:])), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unexpected NAL type %d", ErrMalformedPayload, nalType)
+}
+
+func nalTypeOf(nalu []byte) byte {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return nalu[0] & 0x1F
+}
+
+// SPSID returns the seq_parameter_set_id of an SPS NAL unit.
+func SPSID(sps []byte) (uint32, error) {
+	r, err := nalRBSPReader(sps, 7)
+	if err != nil {
+		return 0, err
+	}
+	// profile_idc, constraint flags and level_idc
+	if err := r.Skip(24); err != nil {
+		return 0, err
+	}
+	id, err := r.ReadUE()
+	if err != nil {
+		return 0, err
+	}
+	if id > 31 {
+		return 0, fmt.Errorf("%w: seq_parameter_set_id %d out of range", ErrMalformedBitstream, id)
+	}
+	return id, nil
+}
+
+// PPSIDs returns the pic_parameter_set_id of a PPS NAL unit and the
+// seq_parameter_set_id it refers to.
+func PPSIDs(pps []byte) (ppsID uint32, spsID uint32, err error) {
+	r, err := nalRBSPReader(pps, 8)
+	if err != nil {
+		return 0, 0, err
+	}
+	if ppsID, err = r.ReadUE(); err != nil {
+		return 0, 0, err
+	}
+	if spsID, err = r.ReadUE(); err != nil {
+		return 0, 0, err
+	}
+	if ppsID > 255 || spsID > 31 {
+		return 0, 0, fmt.Errorf("%w: parameter set ids %d/%d out of range", ErrMalformedBitstream, ppsID, spsID)
+	}
+	return ppsID, spsID, nil
+}
+
+// SlicePPSID returns the pic_parameter_set_id referenced by a coded slice
+// (NAL types 1 and 5).
+func SlicePPSID(slice []byte) (uint32, error) {
+	r, err := nalRBSPReader(slice, 1, 5)
+	if err != nil {
+		return 0, err
+	}
+	// first_mb_in_slice and slice_type
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadUE(); err != nil {
+			return 0, err
+		}
+	}
+	ppsID, err := r.ReadUE()
+	if err != nil {
+		return 0, err
+	}
+	if ppsID > 255 {
+		return 0, fmt.Errorf("%w: pic_parameter_set_id %d out of range", ErrMalformedBitstream, ppsID)
+	}
+	return ppsID, nil
+}
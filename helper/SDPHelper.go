@@ -0,0 +1,139 @@
+package helper
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SDPConfig describes the RTP output an SDP is generated for. Zero values fall
+// back to 127.0.0.1:5004, payload type 96 and no a=ssrc line. The
+// packetization-mode is always 1: the healed output carries FU-A and STAP-A
+// packets, which mode 0 does not allow (RFC 6184 6.2).
+type SDPConfig struct {
+	SessionName string
+	Address     string
+	Port        int
+	PayloadType uint8
+	SSRC        uint32
+	SPS         []byte
+	PPS         []byte
+}
+
+// ProfileLevelID returns the profile-level-id fmtp parameter (RFC 6184 8.1),
+// i.e. profile_idc, the constraint flags and level_idc of the SPS in hex.
+func ProfileLevelID(sps []byte) (string, error) {
+	if len(sps) < 4 {
+		return "", &PayloadError{NalType: 7, Length: len(sps), Needed: 4}
+	}
+	if nalType := sps[0] & 0x1F; nalType != 7 {
+		return "", fmt.Errorf("%w: NAL type %d is not an SPS", ErrMalformedPayload, nalType)
+	}
+	return hex.EncodeToString(sps[1:4]), nil
+}
+
+// BuildSDP returns an SDP (RFC 4566) announcing a single H.264 video stream,
+// with the profile-level-id and sprop-parameter-sets taken from cfg.SPS and cfg.PPS.
+func BuildSDP(cfg SDPConfig) (string, error) {
+	if len(cfg.SPS) == 0 || len(cfg.PPS) == 0 {
+		return "", ErrMissingParameterSets
+	}
+
+	profileLevelID, err := ProfileLevelID(cfg.SPS)
+	if err != nil {
+		return "", err
+	}
+
+	if cfg.SessionName == "" {
+		cfg.SessionName = "Mitra RTP Healer"
+	}
+	if cfg.Address == "" {
+		cfg.Address = "127.0.0.1"
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 5004
+	}
+	if cfg.PayloadType == 0 {
+		cfg.PayloadType = 96
+	}
+
+	addrType := "IP4"
+	if ip := net.ParseIP(cfg.Address); ip != nil && ip.To4() == nil {
+		addrType = "IP6"
+	}
+
+	var b strings.Builder
+	line := func(format string, args ...any) {
+		fmt.Fprintf(&b, format+"\r\n", args...)
+	}
+
+	line("v=0")
+	line("o=- %d 0 IN %s %s", cfg.SSRC, addrType, cfg.Address)
+	line("s=%s", cfg.SessionName)
+	line("c=IN %s %s", addrType, cfg.Address)
+	line("t=0 0")
+	line("m=video %d RTP/AVP %d", cfg.Port, cfg.PayloadType)
+	line("a=rtpmap:%d H264/90000", cfg.PayloadType)
+	line("a=fmtp:%d packetization-mode=1;profile-level-id=%s;sprop-parameter-sets=%s,%s",
+		cfg.PayloadType,
+		profileLevelID,
+		base64.StdEncoding.EncodeToString(cfg.SPS),
+		base64.StdEncoding.EncodeToString(cfg.PPS),
+	)
+	if cfg.SSRC != 0 {
+		line("a=ssrc:%d cname:mitra-rtp-healer", cfg.SSRC)
+	}
+
+	return b.String(), nil
+}
+
+// generates an SDP file for tests purposes like playing incoming stream with ffplay and analysis H264 requirements
+// The SDP uses the BuildSDP defaults; call BuildSDP directly to describe another output.
+func SaveSPSPPSIfNotExists(sps, pps []byte, filename string) error {
+
+	if _, err := os.Stat(filename); err == nil {
+		return nil
+	}
+
+	sdpContent, err := BuildSDP(SDPConfig{SPS: sps, PPS: pps})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("error creating SPS/PPS directory: %w", err)
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating SPS/PPS file: %w", err)
+	}
+	defer file.Close()
+
+	if err := binary.Write(file, binary.BigEndian, uint16(len(sps))); err != nil {
+		return err
+	}
+	if _, err := file.Write(sps); err != nil {
+		return err
+	}
+
+	if err := binary.Write(file, binary.BigEndian, uint16(len(pps))); err != nil {
+		return err
+	}
+	if _, err := file.Write(pps); err != nil {
+		return err
+	}
+
+	sdpFilename := filepath.Join(filepath.Dir(filename), "stream.sdp")
+	err = os.WriteFile(sdpFilename, []byte(sdpContent), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing SDP file: %w", err)
+	}
+
+	return nil
+}
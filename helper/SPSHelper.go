@@ -0,0 +1,250 @@
+package helper
+
+import (
+	"fmt"
+
+	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
+)
+
+// sampleAspectRatios maps aspect_ratio_idc 1..16 to sar_width:sar_height (H.264 table E-1).
+var sampleAspectRatios = [17][2]uint16{
+	{0, 0}, {1, 1}, {12, 11}, {10, 11}, {16, 11}, {40, 33}, {24, 11}, {20, 11}, {32, 11},
+	{80, 33}, {18, 11}, {15, 11}, {64, 33}, {160, 99}, {4, 3}, {3, 2}, {2, 1},
+}
+
+const extendedSAR = 255
+
+// ParseSPS decodes an SPS NAL unit, emulation prevention bytes included.
+func ParseSPS(nalu []byte) (*healerTypes.SPS, error) {
+	br, err := nalRBSPReader(nalu, 7)
+	if err != nil {
+		return nil, err
+	}
+	r := &stickyReader{r: br}
+	sps := &healerTypes.SPS{}
+
+	sps.ProfileIDC = uint8(r.u(8))
+	sps.ConstraintFlags = uint8(r.u(8))
+	sps.LevelIDC = uint8(r.u(8))
+	sps.ID = r.ue()
+
+	sps.ChromaFormatIDC = 1
+	sps.BitDepthLuma = 8
+	sps.BitDepthChroma = 8
+
+	switch sps.ProfileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		sps.ChromaFormatIDC = r.ue()
+		if sps.ChromaFormatIDC == 3 {
+			sps.SeparateColourPlane = r.flag()
+		}
+		sps.BitDepthLuma = r.ue() + 8
+		sps.BitDepthChroma = r.ue() + 8
+		r.u(1) // qpprime_y_zero_transform_bypass_flag
+		sps.ScalingMatrixPresent = r.flag()
+		if sps.ScalingMatrixPresent {
+			lists := 8
+			if sps.ChromaFormatIDC == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists && r.err == nil; i++ {
+				if r.flag() {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					skipScalingList(r, size)
+				}
+			}
+		}
+	}
+
+	sps.Log2MaxFrameNum = r.ue() + 4
+	sps.PicOrderCntType = r.ue()
+	switch sps.PicOrderCntType {
+	case 0:
+		sps.Log2MaxPicOrderCntLsb = r.ue() + 4
+	case 1:
+		sps.DeltaPicOrderAlwaysZero = r.flag()
+		r.se() // offset_for_non_ref_pic
+		r.se() // offset_for_top_to_bottom_field
+		cycle := r.ue()
+		if cycle > 255 {
+			return nil, fmt.Errorf("%w: num_ref_frames_in_pic_order_cnt_cycle %d", ErrMalformedBitstream, cycle)
+		}
+		for i := uint32(0); i < cycle && r.err == nil; i++ {
+			r.se()
+		}
+	}
+
+	sps.MaxNumRefFrames = r.ue()
+	sps.GapsInFrameNumAllowed = r.flag()
+	widthInMbs := r.ue() + 1
+	heightInMapUnits := r.ue() + 1
+	sps.FrameMbsOnly = r.flag()
+	if !sps.FrameMbsOnly {
+		sps.MbAdaptiveFrameField = r.flag()
+	}
+	sps.Direct8x8Inference = r.flag()
+	sps.FrameCropped = r.flag()
+	if sps.FrameCropped {
+		sps.CropLeft = r.ue()
+		sps.CropRight = r.ue()
+		sps.CropTop = r.ue()
+		sps.CropBottom = r.ue()
+	}
+
+	if r.flag() {
+		sps.VUI = parseVUI(r)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := validateSPS(sps, widthInMbs, heightInMapUnits); err != nil {
+		return nil, err
+	}
+	return sps, nil
+}
+
+// validateSPS checks the ranges of H.264 7.4.2.1.1 and computes the cropped size.
+func validateSPS(sps *healerTypes.SPS, widthInMbs uint32, heightInMapUnits uint32) error {
+	switch {
+	case sps.ID > 31:
+		return fmt.Errorf("%w: seq_parameter_set_id %d", ErrMalformedBitstream, sps.ID)
+	case sps.ChromaFormatIDC > 3:
+		return fmt.Errorf("%w: chroma_format_idc %d", ErrMalformedBitstream, sps.ChromaFormatIDC)
+	case sps.Log2MaxFrameNum > 16:
+		return fmt.Errorf("%w: log2_max_frame_num %d", ErrMalformedBitstream, sps.Log2MaxFrameNum)
+	case sps.PicOrderCntType > 2:
+		return fmt.Errorf("%w: pic_order_cnt_type %d", ErrMalformedBitstream, sps.PicOrderCntType)
+	case sps.Log2MaxPicOrderCntLsb > 16:
+		return fmt.Errorf("%w: log2_max_pic_order_cnt_lsb %d", ErrMalformedBitstream, sps.Log2MaxPicOrderCntLsb)
+	case widthInMbs > 1024 || heightInMapUnits > 1024:
+		return fmt.Errorf("%w: picture of %dx%d macroblocks", ErrMalformedBitstream, widthInMbs, heightInMapUnits)
+	}
+
+	frameHeightFactor := uint32(2)
+	if sps.FrameMbsOnly {
+		frameHeightFactor = 1
+	}
+
+	cropUnitX, cropUnitY := uint32(1), frameHeightFactor
+	if !sps.SeparateColourPlane && sps.ChromaFormatIDC != 0 {
+		subWidthC, subHeightC := uint32(1), uint32(1)
+		if sps.ChromaFormatIDC == 1 || sps.ChromaFormatIDC == 2 {
+			subWidthC = 2
+		}
+		if sps.ChromaFormatIDC == 1 {
+			subHeightC = 2
+		}
+		cropUnitX, cropUnitY = subWidthC, subHeightC*frameHeightFactor
+	}
+
+	width := widthInMbs * 16
+	height := frameHeightFactor * heightInMapUnits * 16
+	cropX := uint64(sps.CropLeft+sps.CropRight) * uint64(cropUnitX)
+	cropY := uint64(sps.CropTop+sps.CropBottom) * uint64(cropUnitY)
+	if cropX >= uint64(width) || cropY >= uint64(height) {
+		return fmt.Errorf("%w: cropping larger than the %dx%d picture", ErrMalformedBitstream, width, height)
+	}
+
+	sps.Width = int(uint64(width) - cropX)
+	sps.Height = int(uint64(height) - cropY)
+	return nil
+}
+
+func skipScalingList(r *stickyReader, size int) {
+	lastScale, nextScale := int32(8), int32(8)
+	for j := 0; j < size && r.err == nil; j++ {
+		if nextScale != 0 {
+			delta := r.se()
+			nextScale = (lastScale + delta + 256) % 256
+		}
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
+}
+
+func parseVUI(r *stickyReader) *healerTypes.VUI {
+	vui := &healerTypes.VUI{}
+
+	vui.AspectRatioInfoPresent = r.flag()
+	if vui.AspectRatioInfoPresent {
+		vui.AspectRatioIDC = uint8(r.u(8))
+		if vui.AspectRatioIDC == extendedSAR {
+			vui.SARWidth = uint16(r.u(16))
+			vui.SARHeight = uint16(r.u(16))
+		} else if int(vui.AspectRatioIDC) < len(sampleAspectRatios) {
+			vui.SARWidth = sampleAspectRatios[vui.AspectRatioIDC][0]
+			vui.SARHeight = sampleAspectRatios[vui.AspectRatioIDC][1]
+		}
+	}
+
+	if r.flag() { // overscan_info_present_flag
+		r.u(1) // overscan_appropriate_flag
+	}
+
+	if r.flag() { // video_signal_type_present_flag
+		r.u(3) // video_format
+		vui.VideoFullRange = r.flag()
+		if r.flag() { // colour_description_present_flag
+			r.u(24) // colour_primaries, transfer_characteristics, matrix_coefficients
+		}
+	}
+
+	if r.flag() { // chroma_loc_info_present_flag
+		r.ue()
+		r.ue()
+	}
+
+	vui.TimingInfoPresent = r.flag()
+	if vui.TimingInfoPresent {
+		vui.NumUnitsInTick = r.u(32)
+		vui.TimeScale = r.u(32)
+		vui.FixedFrameRate = r.flag()
+	}
+
+	vui.NalHRDPresent = r.flag()
+	if vui.NalHRDPresent {
+		skipHRDParameters(r)
+	}
+	vui.VclHRDPresent = r.flag()
+	if vui.VclHRDPresent {
+		skipHRDParameters(r)
+	}
+	if vui.NalHRDPresent || vui.VclHRDPresent {
+		r.u(1) // low_delay_hrd_flag
+	}
+	vui.PicStructPresent = r.flag()
+
+	vui.BitstreamRestriction = r.flag()
+	if vui.BitstreamRestriction {
+		r.u(1) // motion_vectors_over_pic_boundaries_flag
+		r.ue() // max_bytes_per_pic_denom
+		r.ue() // max_bits_per_mb_denom
+		r.ue() // log2_max_mv_length_horizontal
+		r.ue() // log2_max_mv_length_vertical
+		vui.MaxNumReorderFrames = r.ue()
+		vui.MaxDecFrameBuffering = r.ue()
+	}
+
+	return vui
+}
+
+func skipHRDParameters(r *stickyReader) {
+	cpbCnt := r.ue() + 1
+	if cpbCnt > 32 {
+		r.err = fmt.Errorf("%w: cpb_cnt %d", ErrMalformedBitstream, cpbCnt)
+		return
+	}
+	r.u(4) // bit_rate_scale
+	r.u(4) // cpb_size_scale
+	for i := uint32(0); i < cpbCnt && r.err == nil; i++ {
+		r.ue() // bit_rate_value_minus1
+		r.ue() // cpb_size_value_minus1
+		r.u(1) // cbr_flag
+	}
+	r.u(20) // four 5-bit delay lengths
+}
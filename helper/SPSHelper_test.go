@@ -0,0 +1,231 @@
+package helper
+
+import (
+	"bytes"
+	"testing"
+
+	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
+)
+
+// testSPS is a progressive 1280x720 High profile SPS, log2_max_frame_num 4,
+// pic_order_cnt_type 0 with log2_max_pic_order_cnt_lsb 6. It carries an
+// emulation prevention byte in its VUI.
+var testSPS = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x6c, 0x80, 0x00, 0x00, 0x03, 0x00, 0x80, 0x00, 0x00, 0x1e, 0x07, 0x8c, 0x18, 0xcb}
+
+// bitWriter builds RBSP payloads for the tests.
+type bitWriter struct {
+	buf []byte
+	pos int
+}
+
+func (w *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if (v>>uint(i))&1 != 0 {
+			w.buf[len(w.buf)-1] |= 1 << (7 - uint(w.pos%8))
+		}
+		w.pos++
+	}
+}
+
+func (w *bitWriter) flag(v bool) {
+	if v {
+		w.bits(1, 1)
+	} else {
+		w.bits(0, 1)
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	n := 0
+	for t := v; t > 1; t >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v, n+1)
+}
+
+// nalu closes the RBSP with its stop bit and returns it as a NAL unit with
+// header, emulation prevention bytes inserted (H.264 7.4.1).
+func (w *bitWriter) nalu(header byte) []byte {
+	w.bits(1, 1)
+	out := []byte{header}
+	zeros := 0
+	for _, b := range w.buf {
+		if zeros >= 2 && b <= 0x03 {
+			out = append(out, 0x03)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// baselineSPS builds a Baseline SPS 0 of widthMbs x heightMapUnits
+// macroblocks (a map unit is two macroblock rows when interlaced),
+// pic_order_cnt_type 2, with optional bottom cropping and VUI timing info.
+func baselineSPS(widthMbs uint32, heightMapUnits uint32, interlaced bool, cropBottom uint32, timeScale uint32) []byte {
+	w := &bitWriter{}
+	w.bits(66, 8)   // profile_idc
+	w.bits(0xc0, 8) // constraint_set0_flag, constraint_set1_flag
+	w.bits(30, 8)   // level_idc
+	w.ue(0)         // seq_parameter_set_id
+	w.ue(0)         // log2_max_frame_num_minus4
+	w.ue(2)         // pic_order_cnt_type
+	w.ue(1)         // max_num_ref_frames
+	w.flag(false)   // gaps_in_frame_num_value_allowed_flag
+	w.ue(widthMbs - 1)
+	w.ue(heightMapUnits - 1)
+	w.flag(!interlaced) // frame_mbs_only_flag
+	if interlaced {
+		w.flag(true) // mb_adaptive_frame_field_flag
+	}
+	w.flag(true) // direct_8x8_inference_flag
+	w.flag(cropBottom > 0)
+	if cropBottom > 0 {
+		w.ue(0)
+		w.ue(0)
+		w.ue(0)
+		w.ue(cropBottom)
+	}
+	w.flag(timeScale > 0) // vui_parameters_present_flag
+	if timeScale > 0 {
+		w.flag(false) // aspect_ratio_info_present_flag
+		w.flag(false) // overscan_info_present_flag
+		w.flag(false) // video_signal_type_present_flag
+		w.flag(false) // chroma_loc_info_present_flag
+		w.flag(true)  // timing_info_present_flag
+		w.bits(1, 32)
+		w.bits(timeScale, 32)
+		w.flag(true)  // fixed_frame_rate_flag
+		w.flag(false) // nal_hrd_parameters_present_flag
+		w.flag(false) // vcl_hrd_parameters_present_flag
+		w.flag(false) // pic_struct_present_flag
+		w.flag(false) // bitstream_restriction_flag
+	}
+	return w.nalu(0x67)
+}
+
+func TestParseSPS(t *testing.T) {
+	timed := baselineSPS(40, 23, false, 0, 50)
+	if !bytes.Contains(timed, []byte{0x00, 0x00, 0x03}) {
+		t.Fatalf("SPS %x has no emulation prevention byte", timed)
+	}
+
+	for _, tc := range []struct {
+		name string
+		nalu []byte
+		want healerTypes.SPS
+		vui  *healerTypes.VUI
+	}{
+		{
+			name: "progressive 720p High",
+			nalu: testSPS,
+			want: healerTypes.SPS{
+				ProfileIDC: 100, LevelIDC: 31, ChromaFormatIDC: 1, BitDepthLuma: 8, BitDepthChroma: 8,
+				Log2MaxFrameNum: 4, PicOrderCntType: 0, Log2MaxPicOrderCntLsb: 6, MaxNumRefFrames: 4,
+				FrameMbsOnly: true, Direct8x8Inference: true, Width: 1280, Height: 720,
+			},
+			vui: &healerTypes.VUI{
+				AspectRatioInfoPresent: true, AspectRatioIDC: 1, SARWidth: 1, SARHeight: 1, VideoFullRange: true,
+				TimingInfoPresent: true, NumUnitsInTick: 1, TimeScale: 60,
+				BitstreamRestriction: true, MaxNumReorderFrames: 2, MaxDecFrameBuffering: 4,
+			},
+		},
+		{
+			name: "interlaced 1080 cropped from 1088",
+			nalu: baselineSPS(120, 34, true, 2, 0),
+			want: healerTypes.SPS{
+				ProfileIDC: 66, ConstraintFlags: 0xc0, LevelIDC: 30, ChromaFormatIDC: 1, BitDepthLuma: 8, BitDepthChroma: 8,
+				Log2MaxFrameNum: 4, PicOrderCntType: 2, MaxNumRefFrames: 1,
+				MbAdaptiveFrameField: true, Direct8x8Inference: true,
+				Width: 1920, Height: 1080, CropBottom: 2, FrameCropped: true,
+			},
+		},
+		{
+			name: "timing info with emulation prevention",
+			nalu: timed,
+			want: healerTypes.SPS{
+				ProfileIDC: 66, ConstraintFlags: 0xc0, LevelIDC: 30, ChromaFormatIDC: 1, BitDepthLuma: 8, BitDepthChroma: 8,
+				Log2MaxFrameNum: 4, PicOrderCntType: 2, MaxNumRefFrames: 1,
+				FrameMbsOnly: true, Direct8x8Inference: true, Width: 640, Height: 368,
+			},
+			vui: &healerTypes.VUI{TimingInfoPresent: true, NumUnitsInTick: 1, TimeScale: 50, FixedFrameRate: true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sps, err := ParseSPS(tc.nalu)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := *sps
+			got.VUI = nil
+			if got != tc.want {
+				t.Errorf("got  %+v\nwant %+v", got, tc.want)
+			}
+			switch {
+			case tc.vui == nil && sps.VUI != nil:
+				t.Errorf("got VUI %+v, want none", *sps.VUI)
+			case tc.vui != nil && (sps.VUI == nil || *sps.VUI != *tc.vui):
+				t.Errorf("got VUI %+v\nwant     %+v", sps.VUI, *tc.vui)
+			}
+		})
+	}
+}
+
+func TestProfileLevelID(t *testing.T) {
+	id, err := ProfileLevelID(testSPS)
+	if err != nil || id != "64001f" {
+		t.Errorf("ProfileLevelID = %q, %v; want 64001f", id, err)
+	}
+	if _, err := ProfileLevelID(testSPS[:3]); err == nil {
+		t.Error("truncated SPS accepted")
+	}
+	if _, err := ProfileLevelID([]byte{0x68, 0xce, 0x3c, 0x80}); err == nil {
+		t.Error("PPS accepted as SPS")
+	}
+}
+
+func TestBuildSDP(t *testing.T) {
+	sdp, err := BuildSDP(SDPConfig{SPS: testSPS, PPS: testPPS, SSRC: 1234})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"c=IN IP4 127.0.0.1\r\n",
+		"m=video 5004 RTP/AVP 96\r\n",
+		"a=rtpmap:96 H264/90000\r\n",
+		"a=fmtp:96 packetization-mode=1;profile-level-id=64001f;sprop-parameter-sets=Z2QAH6zZQFAFuwFsgAAAAwCAAAAeB4wYyw==,aM48gA==\r\n",
+		"a=ssrc:1234 cname:mitra-rtp-healer\r\n",
+	} {
+		if !bytes.Contains([]byte(sdp), []byte(line)) {
+			t.Errorf("SDP lacks %q:\n%s", line, sdp)
+		}
+	}
+
+	if _, err := BuildSDP(SDPConfig{SPS: testSPS}); err == nil {
+		t.Error("SDP built without PPS")
+	}
+}
+
+func FuzzParseSPS(f *testing.F) {
+	f.Add(testSPS)
+	f.Add(testSPS[:4])
+	f.Add([]byte{0x67})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, nalu []byte) {
+		sps, err := ParseSPS(nalu)
+		if err == nil && sps == nil {
+			t.Fatal("nil SPS without an error")
+		}
+	})
+}
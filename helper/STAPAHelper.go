@@ -2,76 +2,18 @@ package helper
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/binary"
 	"fmt"
-	"os"
-	"path/filepath"
 
 	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
 	"github.com/pion/rtp"
 )
 
-// generates an SDP file for tests purposes like playing incoming stream with ffplay and analysis H264 requirements
-func SaveSPSPPSIfNotExists(sps, pps []byte, filename string) error {
-
-	if _, err := os.Stat(filename); err == nil {
-		return nil
-	}
-	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
-		return fmt.Errorf("error under sps pps file creation: %v", err)
-	}
-
-	file, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("erro ao criar arquivo SPS/PPS: %v", err)
-	}
-	defer file.Close()
-
-	if err := binary.Write(file, binary.BigEndian, uint16(len(sps))); err != nil {
-		return err
-	}
-	if _, err := file.Write(sps); err != nil {
-		return err
-	}
-
-	if err := binary.Write(file, binary.BigEndian, uint16(len(pps))); err != nil {
-		return err
-	}
-	if _, err := file.Write(pps); err != nil {
-		return err
-	}
-
-	spsBase64 := base64.StdEncoding.EncodeToString(sps)
-	ppsBase64 := base64.StdEncoding.EncodeToString(pps)
-	spropParam := fmt.Sprintf("packetization-mode=1; sprop-parameter-sets=%s,%s", spsBase64, ppsBase64)
-
-	sdpContent := fmt.Sprintf(
-		"v=0\n"+
-			"o=- 0 0 IN IP4 127.0.0.1\n"+
-			"s=No Name\n"+
-			"c=IN IP4 127.0.0.1\n"+
-			"t=0 0\n"+
-			"m=video 5004 RTP/AVP 96\n"+
-			"a=rtpmap:96 H264/90000\n"+
-			"a=fmtp:96 %s\n",
-		spropParam,
-	)
-
-	sdpFilename := filepath.Join(filepath.Dir(filename), "stream.sdp")
-	err = os.WriteFile(sdpFilename, []byte(sdpContent), 0644)
-	if err != nil {
-		return fmt.Errorf("error under SDP file setup: %v", err)
-	}
-
-	return nil
-}
-
 // ps: its mandatory that the stream NALU packet mode must be 1
 func GenSTAPPacket(sps []byte, pps []byte, header rtp.Header) (rtp.Packet, error) {
 
 	if len(sps) == 0 || len(pps) == 0 {
-		return rtp.Packet{}, fmt.Errorf("rtsp without sprop parameter set")
+		return rtp.Packet{}, ErrMissingParameterSets
 	}
 
 	var buf bytes.Buffer
@@ -79,47 +21,91 @@ func GenSTAPPacket(sps []byte, pps []byte, header rtp.Header) (rtp.Packet, error
 	buf.WriteByte(24)
 
 	if err := binary.Write(&buf, binary.BigEndian, uint16(len(sps))); err != nil {
-		panic("erro ao escrever tamanho do SPS: " + err.Error())
+		return rtp.Packet{}, fmt.Errorf("error writing SPS length: %w", err)
 	}
 	buf.Write(sps)
 
 	if err := binary.Write(&buf, binary.BigEndian, uint16(len(pps))); err != nil {
-		panic("erro ao escrever tamanho do PPS: " + err.Error())
+		return rtp.Packet{}, fmt.Errorf("error writing PPS length: %w", err)
 	}
 	buf.Write(pps)
-	err := SaveSPSPPSIfNotExists(sps, pps, "sps_pps.bin")
-	if err != nil {
-		fmt.Println(err)
-	}
+
 	return rtp.Packet{
 		Header:  header,
 		Payload: buf.Bytes(),
 	}, nil
 }
+
+// SplitSTAPAPacket returns the NAL units aggregated in a STAP-A payload
+// (RFC 6184 5.7.1). The returned slices alias payload. A truncated size field
+// or NAL unit returns a *PayloadError; a zero-sized unit or a non STAP-A
+// payload returns an error wrapping ErrMalformedPayload.
+func SplitSTAPAPacket(payload []byte) ([][]byte, error) {
+	if len(payload) < 1 {
+		return nil, &PayloadError{NalType: 24, Length: 0, Needed: 1}
+	}
+	if nalType := payload[0] & 0x1F; nalType != 24 {
+		return nil, fmt.Errorf("%w: NAL type %d is not STAP-A", ErrMalformedPayload, nalType)
+	}
+
+	var nalus [][]byte
+	offset := 1
+	for offset < len(payload) {
+		if len(payload)-offset < 2 {
+			return nil, &PayloadError{NalType: 24, Length: len(payload), Needed: offset + 2}
+		}
+		size := int(binary.BigEndian.Uint16(payload[offset:]))
+		offset += 2
+
+		if size == 0 {
+			return nil, fmt.Errorf("%w: zero-sized STAP-A unit at byte %d", ErrMalformedPayload, offset-2)
+		}
+		if len(payload)-offset < size {
+			return nil, &PayloadError{NalType: 24, Length: len(payload), Needed: offset + size}
+		}
+
+		nalus = append(nalus, payload[offset:offset+size])
+		offset += size
+	}
+
+	if len(nalus) == 0 {
+		return nil, &PayloadError{NalType: 24, Length: len(payload), Needed: 4}
+	}
+	return nalus, nil
+}
+
+// StapAVerification sends a STAP-A with SPS/PPS ahead of an IDR, either a
+// single NAL unit or the start fragment of a FU-A. Only the first slice of an
+// IDR picture (first_mb_in_slice 0) triggers it.
+// The packet carries no sequence number: whoever drains nc numbers it, ideally
+// through a healer.Sequencer.
 func StapAVerification(params healerTypes.NaluInfo, nc chan *rtp.Packet) error {
 
-	if params.StartBit && params.IsIDR {
+	isSingleNalu := params.FuHeader == 0
+	if params.IsIDR && (params.StartBit || isSingleNalu) && firstSliceOfPicture(params) {
 
 		stapAData, err := GenSTAPPacket(params.Sps, params.Pps, rtp.Header{
-			PayloadType:    96,
-			Version:        2,
-			SequenceNumber: *params.LastSequence,
-			Timestamp:      params.Pkt.Timestamp,
-			Marker:         false,
-			SSRC:           params.Pkt.SSRC,
+			PayloadType: 96,
+			Version:     2,
+			Timestamp:   params.Pkt.Timestamp,
+			Marker:      false,
+			SSRC:        params.Pkt.SSRC,
 		})
 
 		if err != nil {
-			return fmt.Errorf("stream without sps/pps props")
+			return err
 		}
 
 		nc <- &stapAData
-		var arr [][]byte = [][]byte{}
-		b, _ := stapAData.Marshal()
-		arr = append(arr, b)
-		sendRTPPackets("0.0.0.0", 5004, arr)
 
 	}
 
 	return nil
 }
+
+// firstSliceOfPicture reports whether the slice in params starts its picture,
+// so an IDR split over several slices gets a single STAP-A. Without a
+// parseable slice header every IDR slice is treated as the first one.
+func firstSliceOfPicture(params healerTypes.NaluInfo) bool {
+	return params.Slice == nil || params.Slice.FirstMbInSlice == 0
+}
@@ -0,0 +1,40 @@
+package helper
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func FuzzSplitSTAPAPacket(f *testing.F) {
+	stapA, err := GenSTAPPacket(testSPS, testPPS, rtp.Header{})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(stapA.Payload)
+	f.Add([]byte{0x38, 0x00, 0x01, 0x5c})
+	f.Add([]byte{0x38, 0x00, 0x00})
+	f.Add([]byte{0x38, 0x00, 0x05, 0x67})
+	f.Add([]byte{0x38})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		nalus, err := SplitSTAPAPacket(payload)
+		if err != nil {
+			return
+		}
+
+		// the units and their size fields must account for the whole payload
+		rebuilt := []byte{payload[0]}
+		for _, nalu := range nalus {
+			if len(nalu) == 0 {
+				t.Fatal("empty unit")
+			}
+			rebuilt = append(rebuilt, byte(len(nalu)>>8), byte(len(nalu)))
+			rebuilt = append(rebuilt, nalu...)
+		}
+		if !bytes.Equal(rebuilt, payload) {
+			t.Fatalf("units %x do not rebuild payload %x", nalus, payload)
+		}
+	})
+}
@@ -1,8 +1,6 @@
 package helper
 
 import (
-	"fmt"
-
 	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
@@ -55,58 +53,68 @@ import (
 
 */
 
-func BuildSingleNaluFromFUAPackets(naluQeue []*healerTypes.NaluInfo, lastSequence *uint16) (*rtp.Packet, error) {
+// BuildSingleNaluFromFUAPackets glues the fragments of one FU-A back into a single NALU packet.
+// The sequence number is left as received: output numbering belongs to the sequencer.
+func BuildSingleNaluFromFUAPackets(naluQeue []*healerTypes.NaluInfo) (*rtp.Packet, error) {
+	if len(naluQeue) == 0 {
+		return nil, ErrEmptyFUASequence
+	}
+	for _, nalu := range naluQeue {
+		if nalu == nil || nalu.Pkt == nil {
+			return nil, &PayloadError{NalType: 28, Length: 0, Needed: 2}
+		}
+		if len(nalu.Pkt.Payload) < 2 {
+			return nil, &PayloadError{NalType: 28, Length: len(nalu.Pkt.Payload), Needed: 2}
+		}
+	}
 	firstNal := naluQeue[0]
 
 	sampleHeaderNaluHeader := firstNal.Pkt.Payload[0]
 	naluType := firstNal.OriginalNalType
 
 	sampleHeaderNaluHeader = (sampleHeaderNaluHeader & 0b11100000) | (naluType & 0b00011111)
+	for _, nalu := range naluQeue {
+		// one damaged fragment is enough to flag the whole NALU (RFC 6184 5.3)
+		sampleHeaderNaluHeader |= nalu.Pkt.Payload[0] & 0x80
+	}
 
-	concatenatePayload := []byte{}
+	size := 1
 	for _, nalu := range naluQeue {
-		concatenatePayload = append(concatenatePayload, nalu.Pkt.Payload[2:]...)
+		size += len(nalu.Pkt.Payload) - 2
 	}
 
-	singleNaluPayload := append([]byte{sampleHeaderNaluHeader}, concatenatePayload...)
+	singleNaluPayload := make([]byte, 1, size)
+	singleNaluPayload[0] = sampleHeaderNaluHeader
+	for _, nalu := range naluQeue {
+		singleNaluPayload = append(singleNaluPayload, nalu.Pkt.Payload[2:]...)
+	}
 
 	packet := &rtp.Packet{
 		Header:  firstNal.Pkt.Header.Clone(),
 		Payload: singleNaluPayload,
 	}
-	packet.SequenceNumber = *lastSequence
+	// the end fragment tells whether this NALU closes the access unit
+	packet.Marker = naluQeue[len(naluQeue)-1].Pkt.Marker
 
 	return packet, nil
 }
 
-func RetrieveSingleNaluType(pkt *rtp.Packet, lastSequence *uint16, track *webrtc.TrackLocalStaticRTP) byte {
+func RetrieveSingleNaluType(pkt *rtp.Packet, track *webrtc.TrackLocalStaticRTP) (byte, error) {
+	if pkt == nil || len(pkt.Payload) < 1 {
+		return 0, &PayloadError{Length: 0, Needed: 1}
+	}
 	naluHeader := pkt.Payload[0]
 	originalNalType := naluHeader & 0x1F
-	return originalNalType
+	return originalNalType, nil
 }
 
-func MakeSingleNaluStreamApproach(exceeds bool, naluChan chan *rtp.Packet, allNaluInfo *healerTypes.NaluInfo, naluQeue *[]*rtp.Packet, collecting *bool, maxNaluSize int) {
-	if exceeds {
-
-		pkts, _ := FragmentSingleNaluToFUAPackets(*allNaluInfo.Pkt, maxNaluSize, allNaluInfo.LastSequence)
-
-		var infos2 []*healerTypes.NaluInfo
-		for _, nalu := range pkts {
-			info := RetrieveNaluInfo(nalu, allNaluInfo.Sps, allNaluInfo.Pps, &nalu.SequenceNumber, allNaluInfo.Track)
-			infos2 = append(infos2, &info)
-		}
-
-		err := ValidateFUASequence(infos2)
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		StapAVerification(*infos2[0], naluChan)
-
-		for _, d := range pkts {
-			naluChan <- d
-		}
-	} else {
+// MakeSingleNaluStreamApproach forwards single NALUs, re-fragmenting the ones
+// that exceed maxNaluSize into FU-A.
+func MakeSingleNaluStreamApproach(exceeds bool, naluChan chan *rtp.Packet, allNaluInfo *healerTypes.NaluInfo, naluQeue *[]*rtp.Packet, collecting *bool, maxNaluSize int) error {
+	if !exceeds {
+		err := StapAVerification(*allNaluInfo, naluChan)
 		naluChan <- allNaluInfo.Pkt
+		return err
 	}
+	return fragmentAndForward(*allNaluInfo.Pkt, naluChan, allNaluInfo, maxNaluSize)
 }
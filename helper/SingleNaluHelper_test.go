@@ -0,0 +1,41 @@
+package helper
+
+import (
+	"testing"
+
+	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
+	"github.com/pion/rtp"
+)
+
+func FuzzBuildSingleNaluFromFUAPackets(f *testing.F) {
+	f.Add([]byte{0x7c, 0x85, 0x88}, []byte{0x7c, 0x05, 0x84}, []byte{0x7c, 0x45, 0x00})
+	f.Add([]byte{0x7c, 0x85}, []byte{0x7c}, []byte{})
+	f.Add([]byte{0xfc, 0x81, 0x01}, []byte{0x7c, 0x41, 0x02}, []byte{0x5c, 0x41})
+
+	f.Fuzz(func(t *testing.T, first []byte, middle []byte, last []byte) {
+		var fragments []*healerTypes.NaluInfo
+		for i, payload := range [][]byte{first, middle, last} {
+			pkt := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(i), Marker: i == 2}, Payload: payload}
+			info, err := RetrieveNaluInfo(pkt, nil, nil, nil)
+			if err != nil {
+				info = healerTypes.NaluInfo{Pkt: pkt}
+			}
+			fragments = append(fragments, &info)
+		}
+		if err := ValidateFUASequence(fragments); err != nil {
+			return
+		}
+
+		pkt, err := BuildSingleNaluFromFUAPackets(fragments)
+		if err != nil {
+			t.Fatalf("valid sequence not rebuilt: %v", err)
+		}
+		size := 1
+		for _, fragment := range fragments {
+			size += len(fragment.Pkt.Payload) - 2
+		}
+		if len(pkt.Payload) != size {
+			t.Fatalf("rebuilt %d bytes, want %d", len(pkt.Payload), size)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package helper
+
+import (
+	"fmt"
+
+	healerTypes "github.com/LacavaDev/mitra-rtp-healer/apptypes"
+)
+
+// maxSliceHeaderBytes bounds how much of a slice is unescaped to read its
+// header: the fields parsed here always fit, whatever the slice size.
+const maxSliceHeaderBytes = 64
+
+// ParseSliceHeader decodes the header of a coded slice (NAL types 1 and 5).
+// first_mb_in_slice, slice_type and pic_parameter_set_id only need the NAL
+// unit; the following fields are parsed when sps and pps are given and pps is
+// the one the slice references, in which case Complete is set.
+func ParseSliceHeader(nalu []byte, sps *healerTypes.SPS, pps *healerTypes.PPS) (*healerTypes.SliceHeader, error) {
+	if len(nalu) > maxSliceHeaderBytes {
+		nalu = nalu[:maxSliceHeaderBytes]
+	}
+	br, err := nalRBSPReader(nalu, 1, 5)
+	if err != nil {
+		return nil, err
+	}
+	r := &stickyReader{r: br}
+	sh := &healerTypes.SliceHeader{
+		NalRefIdc: (nalu[0] >> 5) & 0x03,
+		IDR:       nalu[0]&0x1F == 5,
+	}
+
+	sh.FirstMbInSlice = r.ue()
+	sh.SliceType = r.ue()
+	sh.PPSID = r.ue()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if sh.SliceType > 9 || sh.PPSID > 255 {
+		return nil, fmt.Errorf("%w: slice_type %d, pic_parameter_set_id %d", ErrMalformedBitstream, sh.SliceType, sh.PPSID)
+	}
+
+	if sps == nil || pps == nil || pps.ID != sh.PPSID || pps.SPSID != sps.ID {
+		return sh, nil
+	}
+
+	if sps.SeparateColourPlane {
+		sh.ColourPlaneID = r.u(2)
+	}
+	sh.FrameNum = r.u(int(sps.Log2MaxFrameNum))
+	if !sps.FrameMbsOnly {
+		sh.FieldPic = r.flag()
+		if sh.FieldPic {
+			sh.BottomField = r.flag()
+		}
+	}
+	if sh.IDR {
+		sh.IDRPicID = r.ue()
+	}
+	switch sps.PicOrderCntType {
+	case 0:
+		sh.PicOrderCntLsb = r.u(int(sps.Log2MaxPicOrderCntLsb))
+		if pps.BottomFieldPicOrderInFramePresent && !sh.FieldPic {
+			sh.DeltaPicOrderCntBottom = r.se()
+		}
+	case 1:
+		if !sps.DeltaPicOrderAlwaysZero {
+			sh.DeltaPicOrderCnt[0] = r.se()
+			if pps.BottomFieldPicOrderInFramePresent && !sh.FieldPic {
+				sh.DeltaPicOrderCnt[1] = r.se()
+			}
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	sh.Complete = true
+	return sh, nil
+}
+
+// FirstSliceOfNewPicture reports whether cur starts a new primary coded
+// picture after prev, following the comparisons of H.264 7.4.1.2.4.
+// Incomplete headers are only compared on their common fields.
+func FirstSliceOfNewPicture(prev *healerTypes.SliceHeader, cur *healerTypes.SliceHeader) bool {
+	if prev == nil {
+		return true
+	}
+	if cur.PPSID != prev.PPSID || cur.IDR != prev.IDR {
+		return true
+	}
+	if (cur.NalRefIdc == 0) != (prev.NalRefIdc == 0) {
+		return true
+	}
+	if !cur.Complete || !prev.Complete {
+		return cur.FirstMbInSlice == 0
+	}
+	return cur.FrameNum != prev.FrameNum ||
+		cur.FieldPic != prev.FieldPic ||
+		cur.BottomField != prev.BottomField ||
+		cur.PicOrderCntLsb != prev.PicOrderCntLsb ||
+		cur.DeltaPicOrderCntBottom != prev.DeltaPicOrderCntBottom ||
+		cur.DeltaPicOrderCnt != prev.DeltaPicOrderCnt ||
+		(cur.IDR && cur.IDRPicID != prev.IDRPicID)
+}
+
+// FrameNumGap reports whether frame_num jumped between two consecutive
+// pictures, which means reference pictures were lost. prev is the first slice
+// of the previous picture and cur the first slice of the new one.
+func FrameNumGap(prev *healerTypes.SliceHeader, cur *healerTypes.SliceHeader, sps *healerTypes.SPS) bool {
+	if prev == nil || cur.IDR || !prev.Complete || !cur.Complete || sps.GapsInFrameNumAllowed {
+		return false
+	}
+	maxFrameNum := uint32(1) << sps.Log2MaxFrameNum
+	expected := prev.FrameNum
+	if prev.NalRefIdc != 0 {
+		expected = (prev.FrameNum + 1) % maxFrameNum
+	}
+	return cur.FrameNum != expected
+}
@@ -0,0 +1,35 @@
+package helper
+
+import "testing"
+
+// testIDR and testSlice are the first bytes of an IDR and of a P slice coded
+// with testSPS and testPPS.
+var (
+	testIDR   = []byte{0x65, 0x88, 0x84, 0x00, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c}
+	testSlice = []byte{0x61, 0x9a, 0x21, 0x00, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c}
+)
+
+func FuzzParseSliceHeader(f *testing.F) {
+	sps, err := ParseSPS(testSPS)
+	if err != nil {
+		f.Fatal(err)
+	}
+	pps, err := ParsePPS(testPPS)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(testIDR, true)
+	f.Add(testSlice, true)
+	f.Add(testIDR, false)
+	f.Add([]byte{0x65}, true)
+	f.Add([]byte{}, false)
+
+	f.Fuzz(func(t *testing.T, nalu []byte, withSets bool) {
+		if withSets {
+			_, _ = ParseSliceHeader(nalu, sps, pps)
+		} else {
+			_, _ = ParseSliceHeader(nalu, nil, nil)
+		}
+	})
+}